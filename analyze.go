@@ -0,0 +1,207 @@
+package stride
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// AnalysisSpec is an analyze query to save
+type AnalysisSpec struct {
+	Query string `json:"query"`
+}
+
+// CreateAnalysis saves an analyze query under the given name
+func (s *Stride) CreateAnalysis(name string, spec AnalysisSpec) (*Response, error) {
+	r := s.Post("/analyze/"+name, &spec)
+	return r, r.Error
+}
+
+// GetAnalysis returns the saved analyze query with the given name
+func (s *Stride) GetAnalysis(name string) (*Response, error) {
+	r := s.Get("/analyze/" + name)
+	return r, r.Error
+}
+
+// DeleteAnalysis deletes the saved analyze query with the given name
+func (s *Stride) DeleteAnalysis(name string) (*Response, error) {
+	r := s.Delete("/analyze/" + name)
+	return r, r.Error
+}
+
+// AnalysisResults runs the saved analyze query with the given name and returns
+// its results, which can be decoded with Columnar
+func (s *Stride) AnalysisResults(name string) *Response {
+	return s.Get("/analyze/" + name + "/results")
+}
+
+// ColumnarResults are analyze results decoded column by column. Data holds a
+// slice of values for each of the Columns, where the i-th value of every
+// column belongs to the i-th row.
+type ColumnarResults struct {
+	Columns []string
+	Data    map[string][]interface{}
+}
+
+// Len returns the number of rows
+func (c *ColumnarResults) Len() int {
+	if len(c.Columns) == 0 {
+		return 0
+	}
+	return len(c.Data[c.Columns[0]])
+}
+
+// DecodeColumnar converts row-oriented analyze results, i.e. a list of objects,
+// into columns. Columns are sorted by name, and rows missing a column have a
+// nil value for it.
+func DecodeColumnar(data interface{}) (*ColumnarResults, error) {
+	rows, ok := data.([]interface{})
+	if !ok {
+		return nil, ErrInvalidResponse
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range rows {
+		row, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidResponse
+		}
+		for k := range row {
+			seen[k] = true
+		}
+	}
+
+	results := &ColumnarResults{
+		Columns: make([]string, 0, len(seen)),
+		Data:    make(map[string][]interface{}, len(seen)),
+	}
+	for k := range seen {
+		results.Columns = append(results.Columns, k)
+		results.Data[k] = make([]interface{}, len(rows))
+	}
+	sort.Strings(results.Columns)
+
+	for i, r := range rows {
+		for k, v := range r.(map[string]interface{}) {
+			results.Data[k][i] = v
+		}
+	}
+
+	return results, nil
+}
+
+// Columnar decodes the response's analyze results into columns
+func (r *Response) Columnar() (*ColumnarResults, error) {
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return DecodeColumnar(r.Data)
+}
+
+// ErrNoResult is returned by ResultsIterator.Scan when there's no current
+// result, i.e. Next wasn't called or returned false
+var ErrNoResult = errors.New("No current result")
+
+// ResultsIterator iterates over the results of a saved analyze query one at a
+// time, holding only a page of them in memory. Each page is either a list of
+// results, or an object with the list under "results" and, if there are more
+// results, the cursor of the next page under "next_cursor", which is then
+// requested with the cursor query parameter. Results returned as a plain list
+// are a single page.
+type ResultsIterator struct {
+	stride *Stride
+	ctx    context.Context
+	path   string
+
+	rows   []json.RawMessage
+	row    json.RawMessage
+	cursor string
+	last   bool
+	err    error
+}
+
+// resultsPage is a page of a paginated analyze query's results
+type resultsPage struct {
+	Results    []json.RawMessage `json:"results"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+// IterateAnalysisResults runs the saved analyze query with the given name and
+// returns an iterator over its results
+func (s *Stride) IterateAnalysisResults(name string) *ResultsIterator {
+	return s.IterateAnalysisResultsContext(context.Background(), name)
+}
+
+// IterateAnalysisResultsContext is like IterateAnalysisResults, with each
+// page's request bound by ctx
+func (s *Stride) IterateAnalysisResultsContext(ctx context.Context, name string) *ResultsIterator {
+	return &ResultsIterator{
+		stride: s,
+		ctx:    ctx,
+		path:   "/analyze/" + name + "/results",
+	}
+}
+
+// Next advances to the next result, requesting the next page once the current
+// one is exhausted. It returns false once there are no more results, or a
+// request failed, which Err then returns.
+func (it *ResultsIterator) Next() bool {
+	it.row = nil
+	for len(it.rows) == 0 {
+		if it.last || it.err != nil {
+			return false
+		}
+		it.fetch()
+	}
+
+	it.row, it.rows = it.rows[0], it.rows[1:]
+	return true
+}
+
+// Scan decodes the current result into v with the client's Codec
+func (it *ResultsIterator) Scan(v interface{}) error {
+	if it.row == nil {
+		return ErrNoResult
+	}
+	return it.stride.codec.Unmarshal(it.row, v)
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *ResultsIterator) Err() error {
+	return it.err
+}
+
+// fetch requests the next page of results
+func (it *ResultsIterator) fetch() {
+	var opts []RequestOption
+	if it.cursor != "" {
+		opts = append(opts, withQuery("cursor", it.cursor))
+	}
+
+	r := it.stride.GetContext(it.ctx, it.path, opts...)
+	if r.Error != nil {
+		it.err = r.Error
+		return
+	}
+
+	raw := bytes.TrimSpace(r.Raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		it.last = true
+		if err := it.stride.codec.Unmarshal(raw, &it.rows); err != nil {
+			it.err = ErrInvalidResponse
+		}
+		return
+	}
+
+	var page resultsPage
+	if err := it.stride.codec.Unmarshal(raw, &page); err != nil {
+		it.err = ErrInvalidResponse
+		return
+	}
+	// A cursor that doesn't move would never end
+	it.last = page.NextCursor == "" || page.NextCursor == it.cursor
+	it.rows = page.Results
+	it.cursor = page.NextCursor
+}
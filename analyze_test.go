@@ -0,0 +1,147 @@
+package stride
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AnalyzeTestSuite struct {
+	suite.Suite
+}
+
+func (suite *AnalyzeTestSuite) TestDecodeColumnar() {
+	var data interface{}
+	json.Unmarshal([]byte(`[
+		{"user": "cartman", "count": 3},
+		{"user": "kenny"},
+		{"user": "kyle", "count": 1, "state": "CO"}
+	]`), &data)
+
+	results, err := DecodeColumnar(data)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, results.Len())
+	assert.Equal(suite.T(), []string{"count", "state", "user"}, results.Columns)
+	assert.Equal(suite.T(), map[string][]interface{}{
+		"count": {float64(3), nil, float64(1)},
+		"state": {nil, nil, "CO"},
+		"user":  {"cartman", "kenny", "kyle"},
+	}, results.Data)
+
+	results, err = (&Response{Data: []interface{}{}}).Columnar()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 0, results.Len())
+
+	_, err = DecodeColumnar(map[string]interface{}{})
+	assert.Equal(suite.T(), ErrInvalidResponse, err)
+	_, err = DecodeColumnar([]interface{}{"row"})
+	assert.Equal(suite.T(), ErrInvalidResponse, err)
+	_, err = (&Response{Error: ErrResourceMissing}).Columnar()
+	assert.Equal(suite.T(), ErrResourceMissing, err)
+}
+
+func (suite *AnalyzeTestSuite) TestAnalysisLifecycle() {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+string(body)))
+		if strings.HasSuffix(r.URL.Path, "/results") {
+			w.Write([]byte(`[{"count": 1}]`))
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	_, err := s.CreateAnalysis("a1", AnalysisSpec{Query: "SELECT 1"})
+	assert.Nil(suite.T(), err)
+	_, err = s.GetAnalysis("a1")
+	assert.Nil(suite.T(), err)
+	results, err := s.AnalysisResults("a1").Columnar()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []interface{}{float64(1)}, results.Data["count"])
+	_, err = s.DeleteAnalysis("a1")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{
+		`POST /analyze/a1 {"query":"SELECT 1"}`,
+		"GET /analyze/a1",
+		"GET /analyze/a1/results",
+		"DELETE /analyze/a1",
+	}, requests)
+
+	_, err = s.GetAnalysis("1a")
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+	_, err = s.CreateAnalysis("1a", AnalysisSpec{Query: "SELECT 1"})
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+}
+
+func (suite *AnalyzeTestSuite) TestResultsIterator() {
+	var cursors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		cursors = append(cursors, cursor)
+		switch {
+		case r.URL.Path == "/analyze/single/results":
+			w.Write([]byte(`[{"i": 0}, {"i": 1}]`))
+		case r.URL.Path == "/analyze/invalid/results":
+			w.Write([]byte(`"results"`))
+		case cursor == "":
+			w.Write([]byte(`{"results": [{"i": 0}, {"i": 1}], "next_cursor": "c1"}`))
+		case cursor == "c1":
+			w.Write([]byte(`{"results": [], "next_cursor": "c2"}`))
+		case cursor == "c2":
+			w.Write([]byte(`{"results": [{"i": 2}]}`))
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	scan := func(it *ResultsIterator) []int {
+		var is []int
+		for it.Next() {
+			var row struct{ I int }
+			assert.Nil(suite.T(), it.Scan(&row))
+			is = append(is, row.I)
+		}
+		return is
+	}
+
+	// Pages are requested by cursor until there's no next one
+	it := s.IterateAnalysisResults("paged")
+	assert.Equal(suite.T(), ErrNoResult, it.Scan(&struct{}{}))
+	assert.Equal(suite.T(), []int{0, 1, 2}, scan(it))
+	assert.Nil(suite.T(), it.Err())
+	assert.Equal(suite.T(), []string{"", "c1", "c2"}, cursors)
+	assert.False(suite.T(), it.Next())
+	assert.Equal(suite.T(), ErrNoResult, it.Scan(&struct{}{}))
+
+	// Unpaginated results are a single page
+	cursors = nil
+	it = s.IterateAnalysisResults("single")
+	assert.Equal(suite.T(), []int{0, 1}, scan(it))
+	assert.Nil(suite.T(), it.Err())
+	assert.Equal(suite.T(), []string{""}, cursors)
+
+	it = s.IterateAnalysisResults("invalid")
+	assert.False(suite.T(), it.Next())
+	assert.Equal(suite.T(), ErrInvalidResponse, it.Err())
+
+	it = s.IterateAnalysisResults("1a")
+	assert.False(suite.T(), it.Next())
+	assert.Equal(suite.T(), ErrInvalidPath, it.Err())
+}
+
+func TestAnalyzeTestSuite(t *testing.T) {
+	suite.Run(t, new(AnalyzeTestSuite))
+}
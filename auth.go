@@ -0,0 +1,68 @@
+package stride
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Authenticator authenticates requests to the Stride API
+type Authenticator interface {
+	// Apply adds the credentials to the request, e.g. as its Authorization
+	// header
+	Apply(req *http.Request)
+}
+
+// BasicAuthenticator authenticates with the API key as the Basic Auth user name
+// and an empty password. It's the default.
+type BasicAuthenticator struct {
+	APIKey string
+}
+
+// Apply sets the request's Basic Auth credentials
+func (a BasicAuthenticator) Apply(req *http.Request) {
+	req.SetBasicAuth(a.APIKey, "")
+}
+
+// BearerAuthenticator authenticates with a bearer token
+type BearerAuthenticator struct {
+	Token string
+}
+
+// Apply sets the request's Authorization header to the bearer token
+func (a BearerAuthenticator) Apply(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+}
+
+// credentials authenticates with the configured Authenticator, or else with a
+// BasicAuthenticator for an API key that may be replaced at any time
+type credentials struct {
+	auth Authenticator
+
+	mu     sync.RWMutex
+	apiKey string
+}
+
+func newCredentials(auth Authenticator, apiKey string) *credentials {
+	return &credentials{auth: auth, apiKey: apiKey}
+}
+
+// Apply authenticates the request with the current credentials
+func (c *credentials) Apply(req *http.Request) {
+	if c.auth != nil {
+		c.auth.Apply(req)
+		return
+	}
+	BasicAuthenticator{APIKey: c.key()}.Apply(req)
+}
+
+func (c *credentials) key() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.apiKey
+}
+
+func (c *credentials) setKey(apiKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiKey = apiKey
+}
@@ -0,0 +1,145 @@
+package stride
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthTestSuite struct {
+	suite.Suite
+}
+
+func (suite *AuthTestSuite) TestAuthenticators() {
+	req, _ := http.NewRequest(http.MethodGet, "https://api.stride.io/v1/collect", nil)
+	BasicAuthenticator{APIKey: "key"}.Apply(req)
+	user, password, ok := req.BasicAuth()
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "key", user)
+	assert.Equal(suite.T(), "", password)
+
+	req, _ = http.NewRequest(http.MethodGet, "https://api.stride.io/v1/collect", nil)
+	BearerAuthenticator{Token: "token"}.Apply(req)
+	assert.Equal(suite.T(), "Bearer token", req.Header.Get("Authorization"))
+
+	// The API key can be replaced unless there's an Authenticator
+	c := newCredentials(nil, "key")
+	c.setKey("key2")
+	req, _ = http.NewRequest(http.MethodGet, "https://api.stride.io/v1/collect", nil)
+	c.Apply(req)
+	user, _, _ = req.BasicAuth()
+	assert.Equal(suite.T(), "key2", user)
+
+	c = newCredentials(BearerAuthenticator{Token: "token"}, "key")
+	c.setKey("key2")
+	req, _ = http.NewRequest(http.MethodGet, "https://api.stride.io/v1/collect", nil)
+	c.Apply(req)
+	assert.Equal(suite.T(), "Bearer token", req.Header.Get("Authorization"))
+}
+
+func (suite *AuthTestSuite) TestSetAPIKey() {
+	var mu sync.Mutex
+	var users []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		mu.Lock()
+		users = append(users, r.URL.Path+" "+user)
+		mu.Unlock()
+		if r.URL.Path == "/collect/stream/subscribe" {
+			// End the connection so that the subscription reconnects
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+	s := NewStride("key1", config)
+	s.Get("/process")
+	s.SetAPIKey("key2")
+	s.Get("/process")
+
+	collectorConfig := NewCollectorConfig()
+	collectorConfig.Endpoint = server.URL
+	collector := NewCollector("key1", collectorConfig)
+	collector.Collect("s0", map[string]interface{}{"i": 0})
+	collector.Flush()
+	collector.SetAPIKey("key2")
+	collector.Collect("s0", map[string]interface{}{"i": 1})
+	collector.Close()
+
+	sub, _ := s.Subscribe("/collect/stream")
+	sub.Start()
+	sub.SetAPIKey("key3")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		rotated := users[len(users)-1] == "/collect/stream/subscribe key3"
+		mu.Unlock()
+		if rotated {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sub.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(suite.T(), []string{
+		"/process key1",
+		"/process key2",
+		"/collect key1",
+		"/collect key2",
+	}, users[:4])
+	assert.Equal(suite.T(), "/collect/stream/subscribe key3", users[len(users)-1])
+}
+
+func (suite *AuthTestSuite) TestAuth() {
+	auths := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.URL.Path + " " + r.Header.Get("Authorization")
+		if r.URL.Path == "/collect/stream/subscribe" {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	// The client, its subscriptions and collectors all use the same scheme
+	auth := BearerAuthenticator{Token: "token"}
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Auth = auth
+	s := NewStride("key", config)
+	assert.Nil(suite.T(), s.Get("/process").Error)
+	assert.Equal(suite.T(), "/process Bearer token", <-auths)
+
+	sub, err := s.Subscribe("/collect/stream")
+	assert.Nil(suite.T(), err)
+	sub.Start()
+	select {
+	case a := <-auths:
+		assert.Equal(suite.T(), "/collect/stream/subscribe Bearer token", a)
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("timed out waiting for the subscription to connect")
+	}
+	sub.Stop()
+
+	collectorConfig := NewCollectorConfig()
+	collectorConfig.Endpoint = server.URL
+	collectorConfig.Auth = auth
+	collector := NewCollector("key", collectorConfig)
+	collector.Collect("s0", map[string]interface{}{"name": "Diane Nguyen"})
+	collector.Close()
+	assert.Equal(suite.T(), "/collect Bearer token", <-auths)
+}
+
+func TestAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthTestSuite))
+}
@@ -0,0 +1,67 @@
+package stride
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Codec marshals and unmarshals JSON. It lets a faster implementation than
+// encoding/json, e.g. json-iterator or segmentio/encoding, be swapped in for
+// the hot paths of encoding request bodies and events and decoding responses.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// StdCodec is the Codec of encoding/json. It's the default.
+type StdCodec struct{}
+
+// Marshal returns the JSON encoding of v
+func (StdCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data into v
+func (StdCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// CodecEncoder returns an Encoder that encodes request bodies as JSON with the
+// codec
+func CodecEncoder(codec Codec) Encoder {
+	return func(data interface{}) ([]byte, string, error) {
+		b, err := codec.Marshal(data)
+		return b, "", err
+	}
+}
+
+// GzipCodecEncoder returns an Encoder that encodes request bodies as gzip
+// compressed JSON with the codec
+func GzipCodecEncoder(codec Codec) Encoder {
+	return func(data interface{}) ([]byte, string, error) {
+		b, err := compressJSON(codec, data, nil)
+		return b, "gzip", err
+	}
+}
+
+// orStdCodec returns codec, or StdCodec if it's nil
+func orStdCodec(codec Codec) Codec {
+	if codec == nil {
+		return StdCodec{}
+	}
+	return codec
+}
+
+// writeJSON writes data to w as JSON followed by a newline. Either way the
+// whole value is encoded in memory before being written to w.
+func writeJSON(codec Codec, w io.Writer, data interface{}) error {
+	if _, ok := codec.(StdCodec); ok {
+		return json.NewEncoder(w).Encode(data)
+	}
+	b, err := codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,175 @@
+package stride
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// countingCodec is encoding/json that counts its calls. Unlike StdCodec, it
+// isn't special-cased by writeJSON, so bodies are encoded with its Marshal.
+type countingCodec struct {
+	marshals   int64
+	unmarshals int64
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt64(&c.marshals, 1)
+	return StdCodec{}.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt64(&c.unmarshals, 1)
+	return StdCodec{}.Unmarshal(data, v)
+}
+
+// okDoer responds to every request with a 200 and body, passing the request's
+// decompressed body to bodies if it's non-nil
+func okDoer(body string, bodies chan<- []byte) Doer {
+	return doerFunc(func(req *http.Request) (*http.Response, error) {
+		if bodies != nil && req.Body != nil {
+			var b []byte
+			if req.Header.Get("Content-Encoding") == "gzip" {
+				gz, _ := gzip.NewReader(req.Body)
+				b, _ = ioutil.ReadAll(gz)
+			} else {
+				b, _ = ioutil.ReadAll(req.Body)
+			}
+			bodies <- b
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		}, nil
+	})
+}
+
+type CodecTestSuite struct {
+	suite.Suite
+}
+
+func (suite *CodecTestSuite) TestWriteJSON() {
+	data := map[string]interface{}{"x": 1, "y": []string{"a", "b"}}
+
+	var std, other bytes.Buffer
+	assert.Nil(suite.T(), writeJSON(StdCodec{}, &std, data))
+	assert.Nil(suite.T(), writeJSON(&countingCodec{}, &other, data))
+	assert.Equal(suite.T(), std.String(), other.String())
+
+	err := writeJSON(&countingCodec{}, &other, map[string]interface{}{"f": func() {}})
+	assert.NotNil(suite.T(), err)
+}
+
+func (suite *CodecTestSuite) TestStride() {
+	codec := &countingCodec{}
+	bodies := make(chan []byte, 1)
+	config := NewConfig()
+	config.Codec = codec
+	config.Client = okDoer(`{"x": 1}`, bodies)
+	s := NewStride("key", config)
+
+	r := s.Post("/process/p1", map[string]interface{}{"query": "SELECT 1"})
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), map[string]interface{}{"x": float64(1)}, r.Data)
+	assert.Equal(suite.T(), `{"query":"SELECT 1"}`, string(<-bodies))
+	assert.Equal(suite.T(), int64(1), codec.marshals)
+	assert.Equal(suite.T(), int64(1), codec.unmarshals)
+
+	var v struct{ X int }
+	assert.Nil(suite.T(), s.GetInto("/process/p1", &v))
+	assert.Equal(suite.T(), 1, v.X)
+	assert.Equal(suite.T(), int64(3), codec.unmarshals)
+
+	// Events written to /collect are compressed, and encoded with the codec too
+	events := []map[string]interface{}{{"x": 1}}
+	s.Post("/collect/s0", events)
+	assert.Equal(suite.T(), "[{\"x\":1}]\n", string(<-bodies))
+	assert.Equal(suite.T(), int64(2), codec.marshals)
+
+	config.Encoders = []EncoderRule{{regexp.MustCompile(`^/collect`), CodecEncoder(codec)}}
+	s.Post("/collect/s0", events)
+	assert.Equal(suite.T(), `[{"x":1}]`, string(<-bodies))
+	assert.Equal(suite.T(), int64(3), codec.marshals)
+}
+
+func (suite *CodecTestSuite) TestCollector() {
+	codec := &countingCodec{}
+	bodies := make(chan []byte, 1)
+	config := NewCollectorConfig()
+	config.Codec = codec
+	config.Client = okDoer(`{}`, bodies)
+	config.ValidateEvents = true
+	config.FlushInterval = time.Hour
+	config.OnFlush = func(FlushResult) {}
+	c := NewCollector("key", config)
+	defer c.Close()
+
+	c.Collect("s0", map[string]interface{}{"x": 1}, map[string]interface{}{"x": 2})
+	assert.Nil(suite.T(), c.Flush())
+	assert.Equal(suite.T(), "{\"s0\":[{\"x\":1},{\"x\":2}]}\n", string(<-bodies))
+
+	// Each event is validated, then the batch is encoded, and the response is
+	// decoded for OnFlush
+	assert.Equal(suite.T(), int64(3), atomic.LoadInt64(&codec.marshals))
+	assert.Equal(suite.T(), int64(1), atomic.LoadInt64(&codec.unmarshals))
+}
+
+func TestCodecTestSuite(t *testing.T) {
+	suite.Run(t, new(CodecTestSuite))
+}
+
+func benchmarkFlush(b *testing.B, codec Codec, compress bool) {
+	config := NewCollectorConfig()
+	config.Codec = codec
+	config.DisableCompression = !compress
+	config.Client = okDoer(`{}`, nil)
+	config.FlushInterval = time.Hour
+	c := NewCollector("key", config)
+	defer c.Close()
+
+	batch := newBatch()
+	events := make([]map[string]interface{}, 1000)
+	for i := range events {
+		events[i] = map[string]interface{}{
+			"$id":  fmt.Sprintf("event-%d", i),
+			"user": fmt.Sprintf("user-%d", i%50),
+			"tags": []string{"a", "b", "c"},
+			"n":    i,
+		}
+	}
+	batch.add(collectRequest{stream: "s0", events: events}, time.Now())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.makeRequest("https://api.stride.io/v1", batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if cc, ok := codec.(*countingCodec); ok && atomic.LoadInt64(&cc.marshals) < int64(b.N) {
+		b.Fatal("Batches weren't encoded with the codec")
+	}
+}
+
+func BenchmarkCollectorFlush(b *testing.B) {
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("std/compress=%v", compress), func(b *testing.B) {
+			benchmarkFlush(b, StdCodec{}, compress)
+		})
+		b.Run(fmt.Sprintf("codec/compress=%v", compress), func(b *testing.B) {
+			benchmarkFlush(b, &countingCodec{}, compress)
+		})
+	}
+}
@@ -2,26 +2,127 @@ package stride
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	tomb "gopkg.in/tomb.v2"
 )
 
+// maxReqsInFlight is the default MaxConcurrentRequests
 const maxReqsInFlight = 1000
 
-// SetTimestamp sets the timestamp of an event
-func SetTimestamp(event map[string]interface{}, ts time.Time) {
-	event[Timestamp] = ts.Format(time.RFC3339Nano)
+// maxIdleConnsPerHost is the number of idle connections the default collector
+// transport keeps to the endpoint. Flushes are usually sequential but overlap
+// under load or when mirroring, and the http package's default of 2 makes any
+// overlap beyond that dial a new connection, which is then closed again
+// straight away. 32 covers such bursts without holding on to an idle socket
+// for each of the MaxConcurrentRequests flushes that could be in flight.
+const maxIdleConnsPerHost = 32
+
+// DeadlineHeader is the request header carrying the deadline hint of a batch
+const DeadlineHeader = "X-Event-Deadline"
+
+// ChecksumHeader is the request header carrying the hex-encoded SHA-256 of
+// the uncompressed collect body
+const ChecksumHeader = "X-Content-SHA256"
+
+// flushDebounce divides FlushInterval into how long after any flush a tick
+// doesn't flush again, since the buffer was only just emptied
+const flushDebounce = 10
+
+const (
+	// An adaptive flush interval halves once the events of recent intervals
+	// fill at least adaptiveHighFill of a batch on average, and doubles once
+	// they fill less than adaptiveLowFill
+	adaptiveHighFill = 0.5
+	adaptiveLowFill  = 0.1
+	// adaptiveRange is how many times shorter and longer than FlushInterval an
+	// adaptive flush interval may get by default
+	adaptiveRange = 10
+)
+
+const (
+	// maxRateLimitWait is the longest a flush is held off for an exhausted
+	// rate limit, so that the buffer doesn't fill while waiting on a long window
+	maxRateLimitWait = 30 * time.Second
+	// Rate limit resets further than maxRateLimitReset in the future are
+	// ignored, since the header or a clock is likely wrong
+	maxRateLimitReset = time.Hour
+)
+
+// SelfTestStream is the stream that SelfTest writes its synthetic event to
+const SelfTestStream = "gostride_self_test"
+
+var (
+	// ErrReservedKey is returned when an event contains an unknown $-prefixed key
+	ErrReservedKey = errors.New("Event contains an unknown reserved key")
+	// ErrInvalidTimestamp is returned when an event's $timestamp isn't RFC3339
+	ErrInvalidTimestamp = errors.New("Event contains an invalid $timestamp")
+	// ErrInvalidID is returned when an event's $id isn't a non-empty string
+	ErrInvalidID = errors.New("Event contains an invalid $id")
+	// ErrCollectorClosed is returned when events are collected after the
+	// collector has shut down
+	ErrCollectorClosed = errors.New("Collector is closed")
+)
+
+// ValidateEvent checks that an event only uses the reserved $timestamp and $id
+// keys, that their values are well-formed, and that the event can be encoded
+// as JSON. Encoding failures are returned as a *BodyError.
+func ValidateEvent(event map[string]interface{}) error {
+	_, err := validateEvent(StdCodec{}, event)
+	return err
 }
 
-// SetID sets the ID of an event
-func SetID(event map[string]interface{}, id string) {
-	event[ID] = id
+// validateEvent is ValidateEvent with the codec, also returning the path to the
+// invalid value
+func validateEvent(codec Codec, event map[string]interface{}) (string, error) {
+	for k, v := range event {
+		if !strings.HasPrefix(k, "$") {
+			continue
+		}
+
+		switch k {
+		case Timestamp:
+			switch ts := v.(type) {
+			case time.Time:
+			case string:
+				if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+					return k, ErrInvalidTimestamp
+				}
+			default:
+				return k, ErrInvalidTimestamp
+			}
+		case ID:
+			if id, ok := v.(string); !ok || id == "" {
+				return k, ErrInvalidID
+			}
+		default:
+			return k, ErrReservedKey
+		}
+	}
+
+	if _, err := codec.Marshal(event); err != nil {
+		e := newBodyError(event, err)
+		return e.Path, e
+	}
+
+	return "", nil
 }
 
 // CollectorConfig is the configuration for Stride collector
@@ -31,15 +132,232 @@ type CollectorConfig struct {
 	Timeout       time.Duration
 	Endpoint      string
 	Debug         bool
+	Observer      Observer
+
+	// Logger is where the collector logs to. If it's the default logger and
+	// Debug is set, the collector logs to its own logger at debug level.
+	Logger Logger
+
+	// RootCAs, if set, is the pool of root certificates the endpoint's TLS
+	// certificate chain is verified against instead of the system pool
+	RootCAs *x509.CertPool
+
+	// Transport, if set, is the transport the collector's requests are made
+	// with, e.g. to share a connection pool between collectors, and RootCAs is
+	// ignored. Otherwise each collector gets a transport from
+	// newCollectorTransport.
+	Transport *http.Transport
+
+	// Client, if set, issues the collector's requests instead of an
+	// *http.Client, e.g. a fake in tests. Timeout, RootCAs and Transport only
+	// configure the default client, so they're ignored.
+	Client Doer
+
+	// UserAgent, e.g. "myapp/1.2", is appended to the User-Agent of the
+	// collector's requests, after the library's own token
+	UserAgent string
+
+	// Auth authenticates the collector's requests. It defaults to a
+	// BasicAuthenticator for the collector's API key.
+	Auth Authenticator
+
+	// Codec encodes the collector's batches, and the events it validates or
+	// sizes for MaxBatchBytes. It defaults to StdCodec.
+	Codec Codec
+
+	// Tracer, if set, starts a span around each request that flushes a batch
+	Tracer Tracer
+
+	// MaxBatchBytes, if set, flushes once the buffered events' approximate
+	// uncompressed JSON size reaches this many bytes, independently of
+	// BatchSize. The events of a single Collect call are never split, so
+	// they're sent in a request of their own if they're larger.
+	MaxBatchBytes int
+
+	// MaxBufferAge bounds how long the oldest buffered event may wait before
+	// being flushed, independent of the FlushInterval ticker. Zero disables it.
+	MaxBufferAge time.Duration
+
+	// InitialDelay suppresses FlushInterval flushes for this long after the
+	// collector starts, so that a startup burst of events is sent in a few
+	// full batches rather than many small ones. BatchSize and MaxBufferAge
+	// still apply. It's ignored if Window is set.
+	InitialDelay time.Duration
+
+	// MaxLifetime shuts the collector down after it has been running for the
+	// given duration, flushing any buffered events as if Close was called. Zero
+	// disables it.
+	MaxLifetime time.Duration
+
+	// Once FallbackThreshold consecutive flushes have failed, Collect degrades to
+	// sending events synchronously, retrying up to FallbackRetries times spaced
+	// by FlushInterval, until a request succeeds again. Events that still fail to
+	// send are buffered as usual. Zero disables the fallback.
+	FallbackThreshold int
+	FallbackRetries   int
+
+	// Window, if set, replaces FlushInterval with flushes aligned to fixed
+	// wall-clock windows of this size, starting WindowOffset past each multiple
+	// of Window, so that every request only holds events collected during a
+	// single window. BatchSize and MaxBufferAge may still flush a window early.
+	Window       time.Duration
+	WindowOffset time.Duration
+
+	// AdaptiveFlush adjusts the interval between flushes to the rate events
+	// are collected at, starting from FlushInterval. The interval halves while
+	// each interval's events fill much of a batch, to keep latency down during
+	// bursts, and doubles while they barely fill one, so that quiet periods
+	// send fewer, larger batches. It stays within MinFlushInterval and
+	// MaxFlushInterval, which default to a tenth and ten times FlushInterval.
+	// Ignored if Window is set.
+	AdaptiveFlush    bool
+	MinFlushInterval time.Duration
+	MaxFlushInterval time.Duration
+
+	// BlockedWarnThreshold is how long a Collect call may block waiting for
+	// room in the collector's buffer before a warning is logged. Repeated
+	// warnings are limited by ErrorLogInterval. Zero disables the warning.
+	BlockedWarnThreshold time.Duration
+
+	// ErrorLogInterval is the minimum interval between repeated logs of the
+	// same error. Zero logs every occurrence.
+	ErrorLogInterval time.Duration
+
+	// MaxStreams caps the number of distinct streams buffered at once. Events
+	// for a new stream beyond the cap force a flush of the buffered events
+	// first. Zero means no limit.
+	MaxStreams int
+
+	// MaxConcurrentRequests bounds the number of flushes in flight at once.
+	// Once it's reached, further flushes wait for one to complete, and events
+	// back up into Collect. Zero means the default of 1000, and it must not be
+	// negative.
+	MaxConcurrentRequests int
+
+	// DrainTimeout bounds how long shutdown spends taking in the events still
+	// in the collector's buffer, which includes flushing the batches they fill.
+	// Events that weren't taken in by then are counted as dropped. Zero means
+	// no limit.
+	DrainTimeout time.Duration
+
+	// MirrorEndpoints are additional endpoints that every flush is sent to
+	// alongside Endpoint, e.g. to dual-write during a migration. A flush only
+	// fails if it failed for every endpoint, unless RequireAllEndpoints is set,
+	// in which case it fails if it failed for any. Failures are reported as a
+	// *FanOutError. Retries of a batch, and the recovery of its spilled events,
+	// only send it to the endpoints that didn't accept it.
+	MirrorEndpoints     []string
+	RequireAllEndpoints bool
+
+	// ValidateContentType fails flushes whose successful response isn't JSON,
+	// which usually means Endpoint doesn't point at the Stride API
+	ValidateContentType bool
+
+	// DisableCompression sends request bodies uncompressed rather than gzipped
+	DisableCompression bool
+
+	// StreamCompression encodes and compresses each batch while it's sent,
+	// through a pipe feeding the request body, rather than into a buffer
+	// beforehand, so that a large batch's JSON and compressed body are never
+	// held in full. Requests then have no Content-Length. It's ignored if
+	// DisableCompression, Checksum or DryRun is set, which need the whole body
+	// before it's sent.
+	StreamCompression bool
+
+	// ValidateEvents checks each event with ValidateEvent in Collect, so that
+	// an invalid event doesn't fail the whole batch it would be flushed in.
+	// Invalid events are counted as failed and passed to OnError, the valid
+	// events of the call are collected as usual, and Collect returns a
+	// *BodyError for the first invalid event. It's off by default, since each
+	// event is encoded an extra time and keys starting with $ other than the
+	// reserved ones are rejected.
+	ValidateEvents bool
+
+	// Synchronous sends the events of each Collect call immediately, returning
+	// the error of the request from Collect, rather than buffering them. It's
+	// intended for tests of code that uses the collector.
+	Synchronous bool
+
+	// DryRun encodes each batch as usual, but logs it at debug level instead of
+	// sending it, and counts its events as delivered. It's useful to check the
+	// events and batching of a new integration without writing to Stride.
+	DryRun bool
+
+	// LogSummary logs a summary of the collector's lifetime stats at info level
+	// once it shuts down. Off by default.
+	LogSummary bool
+
+	// Checksum attaches the SHA-256 of each uncompressed batch in the
+	// ChecksumHeader, so that the server can verify it wasn't corrupted
+	Checksum bool
+
+	// Idempotency attaches a random key to each batch in the
+	// IdempotencyKeyHeader. The key is kept when the batch is sent again, e.g.
+	// to mirror endpoints or after AutoCreateStreams, so the server can
+	// deduplicate it.
+	Idempotency bool
+
+	// DedupeByID keeps only the last of the events of a stream with the same
+	// $id in each flushed batch, e.g. those of a producer retrying Collect.
+	// Duplicates are replaced as they're buffered, so they don't count towards
+	// BatchSize or MaxBatchBytes. Events without an $id are always kept.
+	DedupeByID bool
+
+	// AutoCreateStreams creates the streams of a batch that the server reports
+	// as missing and then retries the flush once
+	AutoCreateStreams bool
+
+	// DeadLetterCapacity is the number of most recent events that failed to
+	// send which are retained for DeadLetters. Zero disables it.
+	DeadLetterCapacity int
+
+	// OnError, if set, is called with each stream's events of a batch that
+	// failed to send, e.g. to retry or persist them. It runs on the goroutine
+	// that flushed the batch, which holds one of the collector's in-flight
+	// request slots until it returns, so it must not block indefinitely.
+	OnError func(stream string, events []map[string]interface{}, err error)
+
+	// OnFlush, if set, is called with the outcome of each successful flush to
+	// each endpoint, including how many of each stream's events the server
+	// accepted and rejected. Like OnError, it runs on the flushing goroutine.
+	OnFlush func(result FlushResult)
+
+	// RecordPath, if set, is a file that every Collect call is recorded to so
+	// that the session can be reproduced with Replay
+	RecordPath string
+
+	// SpillPath, if set, is a file that events are appended to as JSON lines
+	// if they couldn't be sent while the collector shut down, either because
+	// their flush failed or because DrainTimeout elapsed before they were taken
+	// in. Recover collects them again, e.g. once the process restarts, so that
+	// they're delivered at least once.
+	SpillPath string
+
+	// FlushOnSignal closes the collector once the process receives SIGINT or
+	// SIGTERM, e.g. when its container is stopped, so that its buffered events
+	// are flushed before the process exits. The signal is then delivered
+	// again, with the handler removed, so that the process still terminates.
+	// Applications that handle these signals themselves should close the
+	// collector from their own handler instead. SignalTimeout bounds the
+	// shutdown like the context of CloseContext, and zero means no limit.
+	FlushOnSignal bool
+	SignalTimeout time.Duration
 }
 
 // defaultCollectorConfig is the default configuration
 var defaultCollectorConfig = &CollectorConfig{
-	250 * time.Millisecond,
-	1000,
-	5 * time.Second,
-	Endpoint,
-	false,
+	FlushInterval: 250 * time.Millisecond,
+	BatchSize:     1000,
+	Timeout:       5 * time.Second,
+	Endpoint:      Endpoint,
+	Debug:         false,
+	Logger:        defaultLogger,
+
+	MaxConcurrentRequests: maxReqsInFlight,
+	DrainTimeout:          10 * time.Second,
+	SignalTimeout:         10 * time.Second,
+	BlockedWarnThreshold:  100 * time.Millisecond,
+	ErrorLogInterval:      10 * time.Second,
 }
 
 // NewCollectorConfig returns a new default collector config
@@ -49,47 +367,355 @@ func NewCollectorConfig() *CollectorConfig {
 }
 
 type collectRequest struct {
-	stream string
-	events []map[string]interface{}
+	stream   string
+	events   []map[string]interface{}
+	deadline time.Time
+
+	// Events keyed by stream, instead of stream and events, for CollectBatch
+	streams map[string][]map[string]interface{}
+
+	// Approximate encoded size of events, if MaxBatchBytes is set
+	bytes int
+
+	// Endpoints that still have to accept the events, if they were spilled
+	// after a flush failed for only some of them. Nil means every endpoint.
+	endpoints []string
+}
+
+// each calls f with the events of each of the request's streams
+func (r *collectRequest) each(f func(stream string, events []map[string]interface{})) {
+	if r.streams == nil {
+		f(r.stream, r.events)
+		return
+	}
+	for stream, events := range r.streams {
+		f(stream, events)
+	}
+}
+
+// size returns the number of events in the request
+func (r *collectRequest) size() int {
+	n := 0
+	r.each(func(_ string, events []map[string]interface{}) {
+		n += len(events)
+	})
+	return n
+}
+
+// batch is a set of buffered events that are flushed in a single request
+type batch struct {
+	events map[string][]map[string]interface{}
+	size   int
+	bytes  int
+
+	// Earliest deadline hint of any buffered request
+	deadline time.Time
+
+	// Idempotency key of the batch, if Idempotency is set
+	key string
+
+	// When the first and last events were buffered, and when the batch was flushed
+	oldest  time.Time
+	newest  time.Time
+	flushed time.Time
+
+	// Endpoints that accepted the batch, which retries don't send it to again
+	sent map[string]bool
+
+	// Index of each stream's events by $id, if DedupeByID is set
+	ids map[string]map[string]int
+}
+
+func newBatch() *batch {
+	return &batch{events: make(map[string][]map[string]interface{})}
+}
+
+// eventBytes returns the approximate size of events once encoded in a batch
+func eventBytes(codec Codec, events []map[string]interface{}) int {
+	n := 0
+	for _, event := range events {
+		b, _ := codec.Marshal(event)
+		n += len(b) + 1
+	}
+	return n
+}
+
+func (b *batch) add(req collectRequest, now time.Time) {
+	req.each(func(stream string, events []map[string]interface{}) {
+		if _, ok := b.events[stream]; !ok {
+			// "stream":[],
+			b.bytes += len(stream) + 6
+		}
+		b.events[stream] = append(b.events[stream], events...)
+		b.size += len(events)
+	})
+	b.bytes += req.bytes
+	if !req.deadline.IsZero() && (b.deadline.IsZero() || req.deadline.Before(b.deadline)) {
+		b.deadline = req.deadline
+	}
+	if b.oldest.IsZero() {
+		b.oldest = now
+	}
+	b.newest = now
+}
+
+// addDeduped adds the events of req like add, except that an event with the
+// same $id as one of its stream's buffered events replaces it in place. It
+// returns the number of events discarded. If codec is non-nil, their size is
+// subtracted from bytes.
+func (b *batch) addDeduped(req collectRequest, now time.Time, codec Codec) int {
+	if b.ids == nil {
+		b.ids = make(map[string]map[string]int)
+	}
+
+	removed := 0
+	deduped := collectRequest{
+		streams:  make(map[string][]map[string]interface{}),
+		deadline: req.deadline,
+		bytes:    req.bytes,
+	}
+	req.each(func(stream string, events []map[string]interface{}) {
+		ids := b.ids[stream]
+		if ids == nil {
+			ids = make(map[string]int)
+			b.ids[stream] = ids
+		}
+
+		buffered := b.events[stream]
+		kept := make([]map[string]interface{}, 0, len(events))
+		for _, event := range events {
+			id, ok := event[ID].(string)
+			if !ok {
+				kept = append(kept, event)
+				continue
+			}
+
+			i, ok := ids[id]
+			if !ok {
+				ids[id] = len(buffered) + len(kept)
+				kept = append(kept, event)
+				continue
+			}
+
+			var replaced map[string]interface{}
+			if i < len(buffered) {
+				replaced, buffered[i] = buffered[i], event
+			} else {
+				replaced, kept[i-len(buffered)] = kept[i-len(buffered)], event
+			}
+			if codec != nil {
+				deduped.bytes -= eventBytes(codec, []map[string]interface{}{replaced})
+			}
+			removed++
+		}
+		deduped.streams[stream] = kept
+	})
+
+	b.add(deduped, now)
+	return removed
+}
+
+// latencyBuckets are the upper bounds of the buffering latency histogram
+var latencyBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// CollectorStats are cumulative statistics about a Collector's requests
+type CollectorStats struct {
+	// Events passed to Collect, those that were sent successfully or failed
+	// to send, and those discarded because the collector had shut down
+	Collected int64
+	Delivered int64
+	Failed    int64
+	Dropped   int64
+
+	// Events discarded by DedupeByID in favor of a later event with their $id
+	Deduplicated int64
+
+	// Events in the batch currently being buffered
+	Buffered int64
+
+	// Batches flushed, those of them that failed, and requests currently in
+	// flight
+	Batches       int64
+	FailedBatches int64
+	InFlight      int
+
+	// How long the collector has been running
+	Uptime time.Duration
+
+	// Bytes written to and read from the wire, after compression
+	BytesSent     int64
+	BytesReceived int64
+
+	// Cumulative time Collect calls spent blocked on a full buffer
+	BlockedTime time.Duration
+
+	// Content-Encoding of the most recent flush, empty if it wasn't compressed,
+	// and its compression level
+	LastFlushEncoding         string
+	LastFlushCompressionLevel int
+
+	// Histogram of how long the oldest event of each flushed batch was buffered.
+	// Latency[i] counts the batches with a latency up to LatencyBuckets[i], and
+	// the last element of Latency counts those exceeding every bucket.
+	LatencyBuckets []time.Duration
+	Latency        []int64
 }
 
 // Collector is an asynchronous client to the Stride API's collect endpoint.
 type Collector struct {
-	apiKey string
+	// Stats, accessed atomically so they must stay 64-bit aligned
+	collected     int64
+	delivered     int64
+	failed        int64
+	dropped       int64
+	buffered      int64
+	batches       int64
+	failedBatches int64
+	deduplicated  int64
+	bytesSent     int64
+	bytesReceived int64
+	latency       [len(latencyBuckets) + 1]int64
+	blockedTime   int64
+
+	// Number of consecutive failed requests, accessed atomically
+	failures int32
+
+	// *RequestMetrics of the most recent flush
+	lastFlush atomic.Value
+
+	auth    *credentials
+	started time.Time
 
 	// config
 	config *CollectorConfig
 
-	client   *http.Client
+	client   Doer
+	codec    Codec
 	incoming chan collectRequest
+	flushes  chan chan<- error
 
-	// Synchronization for ensuring we don't have more than `maxReqsInFlight`
-	// concurrent async collect requests
+	// Synchronization for ensuring we don't have more than
+	// MaxConcurrentRequests concurrent async collect requests
 	wg        sync.WaitGroup
 	semaphone chan bool
 
 	// Go-routine lifecycle
 	tomb tomb.Tomb
+
+	// Parent context, and the context bounding flushes by its deadline
+	ctx         context.Context
+	flushCtx    context.Context
+	cancelFlush context.CancelFunc
+
+	// Guards closing incoming while Collect calls may be sending to it
+	closeMu sync.RWMutex
+	closed  bool
+
+	recorder    *recorder
+	spiller     *spiller
+	deadLetters *deadLetters
+	errors      *errorLimiter
+	logger      Logger
+
+	// Streams created by AutoCreateStreams
+	createdMu sync.Mutex
+	created   map[string]bool
+
+	// When each endpoint's exhausted rate limit resets
+	rateLimitMu sync.Mutex
+	rateLimited map[string]time.Time
+
+	compressionLogged sync.Once
 }
 
 // NewCollector returns a new collector
 func NewCollector(apiKey string, config *CollectorConfig) *Collector {
+	return NewCollectorContext(context.Background(), apiKey, config)
+}
+
+// NewCollectorContext returns a new collector whose lifecycle is tied to ctx.
+// Cancelling ctx shuts the collector down, flushing any buffered events as if
+// Close was called, and if ctx has a deadline no flush will outlive it. Close
+// may still be called, and waits for the shutdown to complete.
+func NewCollectorContext(ctx context.Context, apiKey string, config *CollectorConfig) *Collector {
 	if config == nil {
 		config = defaultCollectorConfig
 	}
 
+	// Only bound flushes by ctx's deadline, so that cancelling ctx doesn't abort
+	// the final flush of the buffered events
+	flushCtx, cancelFlush := context.WithCancel(context.Background())
+	if deadline, ok := ctx.Deadline(); ok {
+		cancelFlush()
+		flushCtx, cancelFlush = context.WithDeadline(context.Background(), deadline)
+	}
+
 	c := &Collector{
-		apiKey: apiKey,
-		config: config,
-		client: &http.Client{
-			Timeout: config.Timeout,
-		},
-		incoming:  make(chan collectRequest, 100),
-		semaphone: make(chan bool, maxReqsInFlight),
+		ctx:         ctx,
+		flushCtx:    flushCtx,
+		cancelFlush: cancelFlush,
+		auth:        newCredentials(config.Auth, apiKey),
+		started:     time.Now(),
+		config:      config,
+		codec:       orStdCodec(config.Codec),
+		incoming:    make(chan collectRequest, 100),
+		flushes:     make(chan chan<- error),
+		semaphone:   make(chan bool, maxConcurrentRequests(config)),
+		errors:      newErrorLimiter(config.ErrorLogInterval),
+		logger:      config.Logger,
+		created:     make(map[string]bool),
+		rateLimited: make(map[string]time.Time),
+	}
+
+	switch {
+	case config.Client != nil:
+		c.client = config.Client
+	case config.Transport != nil:
+		c.client = &http.Client{Timeout: config.Timeout, Transport: config.Transport}
+	default:
+		c.client = &http.Client{Timeout: config.Timeout, Transport: newCollectorTransport(config.RootCAs)}
+	}
+
+	if c.logger == nil {
+		c.logger = defaultLogger
+	}
+	if c.config.Debug && c.logger == defaultLogger {
+		// Only raise the level of this collector's logs
+		l := logrus.New()
+		l.Level = logrus.DebugLevel
+		c.logger = NewLogrusLogger(l)
+	}
+
+	if c.config.DeadLetterCapacity > 0 {
+		c.deadLetters = newDeadLetters(c.config.DeadLetterCapacity)
+	}
+
+	if c.config.RecordPath != "" {
+		r, err := newRecorder(c.config.RecordPath, c.logger)
+		if err != nil {
+			newEntry(c.logger, Fields{
+				"module": "collector",
+				"path":   c.config.RecordPath,
+			}).WithError(err).Error("Failed to open collector recording")
+		} else {
+			c.recorder = r
+		}
 	}
 
-	if c.config.Debug {
-		log.Level = logrus.DebugLevel
+	if c.config.SpillPath != "" {
+		c.spiller = newSpiller(c.config.SpillPath, c.logger)
+	}
+
+	if c.config.FlushOnSignal {
+		watchSignals(c)
 	}
 
 	// Start the goroutine that issues async requests to Stride API
@@ -98,134 +724,1353 @@ func NewCollector(apiKey string, config *CollectorConfig) *Collector {
 	return c
 }
 
-func (c *Collector) makeRequest(events map[string][]map[string]interface{}) error {
-	lg := log.WithFields(logrus.Fields{
-		"endpoint": c.config.Endpoint,
-		"module":   "collector",
-		"function": "makeRequest",
-	})
+// FanOutError is returned when a flush mirrored to multiple endpoints failed
+// for some of them. Errors maps each failed endpoint to its error.
+type FanOutError struct {
+	Errors map[string]error
+}
 
-	b, err := json.Marshal(events)
-	if err != nil {
-		lg.WithError(err).Error("Failed to JSONify request body")
-		return ErrInvalidBody
+func (e *FanOutError) Error() string {
+	endpoints := make([]string, 0, len(e.Errors))
+	for endpoint, err := range e.Errors {
+		endpoints = append(endpoints, fmt.Sprintf("%s: %s", endpoint, err))
 	}
+	sort.Strings(endpoints)
 
-	b, err = compressBody(b)
-	if err != nil {
-		lg.WithError(err).Error("Failed to compress request body")
+	return "Flush failed for some endpoints (" + strings.Join(endpoints, ", ") + ")"
+}
+
+// failedEndpoints returns the endpoints that err reports a flush failed for,
+// sorted, or nil if it failed for every endpoint
+func failedEndpoints(err error) []string {
+	failed, ok := err.(*FanOutError)
+	if !ok {
+		return nil
 	}
 
-	url := c.config.Endpoint + "/collect"
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(b))
+	endpoints := make([]string, 0, len(failed.Errors))
+	for endpoint := range failed.Errors {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
 
-	req.Header.Add("Content-Encoding", "gzip")
-	req.Header.Add("User-Agent", fmt.Sprintf("gostride (version: %s)", Version))
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Content-Length", fmt.Sprintf("%d", len(b)))
-	req.SetBasicAuth(c.apiKey, "")
+// endpoints returns the endpoint followed by any mirror endpoints
+func (c *Collector) endpoints() []string {
+	return append([]string{c.config.Endpoint}, c.config.MirrorEndpoints...)
+}
 
-	res, err := c.client.Do(req)
-	if err != nil {
-		lg.WithError(err).Error("Request to Stride API failed")
-		return ErrRequestFailed
+// flush sends a batch to the endpoint and any mirror endpoints that haven't
+// accepted it yet
+func (c *Collector) flush(batch *batch) error {
+	if c.config.Idempotency && batch.key == "" {
+		batch.key = newIdempotencyKey()
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode == 200 {
-		return nil
+	if len(c.config.MirrorEndpoints) == 0 {
+		if batch.sent[c.config.Endpoint] {
+			return nil
+		}
+		return c.flushTo(c.config.Endpoint, batch)
 	}
 
-	lg.WithField("status_code", res.StatusCode).Error("Stride API returned invalid status code")
-	return errorFromStatusCode(res.StatusCode)
-}
+	endpoints := c.endpoints()
+	errs := make([]error, len(endpoints))
 
-func (c *Collector) start() error {
-	lg := log.WithFields(logrus.Fields{
-		"endpoint": c.config.Endpoint,
-		"module":   "collector",
-	})
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		if batch.sent[endpoint] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			errs[i] = c.flushTo(endpoint, batch)
+		}(i, endpoint)
+	}
+	wg.Wait()
 
-	tick := time.NewTicker(c.config.FlushInterval)
-	events := make(map[string][]map[string]interface{})
-	numBuffered := 0
+	failed := &FanOutError{Errors: make(map[string]error)}
+	for i, err := range errs {
+		switch {
+		case err != nil:
+			failed.Errors[endpoints[i]] = err
+		case !batch.sent[endpoints[i]]:
+			if batch.sent == nil {
+				batch.sent = make(map[string]bool)
+			}
+			batch.sent[endpoints[i]] = true
+		}
+	}
 
-	lg.Debug("Starting collector...")
+	switch {
+	case len(failed.Errors) == 0:
+		return nil
+	case len(failed.Errors) < len(endpoints) && !c.config.RequireAllEndpoints:
+		newEntry(c.logger, Fields{
+			"module": "collector",
+			"errors": failed.Errors,
+		}).Warn("Flush failed for some mirror endpoints")
+		return nil
+	default:
+		return failed
+	}
+}
 
-	flushEvents := func() {
-		c.semaphone <- true
-		c.wg.Add(1)
+// logDryRun logs the batch that would have been sent, given its uncompressed
+// payload, along with the number of events of each of its streams
+func (c *Collector) logDryRun(lg *entry, batch *batch, payload []byte) {
+	streams := make(map[string]int, len(batch.events))
+	for stream, events := range batch.events {
+		streams[stream] = len(events)
+	}
 
-		lg.WithFields(logrus.Fields{
-			"num_events":  numBuffered,
-			"num_streams": len(events),
-		}).Debug("Flushing events to server")
+	lg.WithFields(Fields{
+		"num_events": batch.size,
+		"streams":    streams,
+		"payload":    string(bytes.TrimRight(payload, "\n")),
+	}).Debug("Dry run, not sending events")
+}
 
-		go func(events map[string][]map[string]interface{}) {
-			c.makeRequest(events)
-			c.wg.Done()
-			<-c.semaphone
-		}(events)
+// flushTo sends a batch to an endpoint, creating any missing streams if
+// AutoCreateStreams is set
+func (c *Collector) flushTo(endpoint string, batch *batch) error {
+	c.waitRateLimit(endpoint)
 
-		// Reset
-		events = make(map[string][]map[string]interface{})
-		numBuffered = 0
+	err := c.makeRequest(endpoint, batch)
+	if err == ErrResourceMissing && c.config.AutoCreateStreams && c.createStreams(endpoint, batch) {
+		err = c.makeRequest(endpoint, batch)
 	}
+	return err
+}
 
-	for {
-		select {
-		case req, ok := <-c.incoming:
-			if !ok {
-				break
-			}
+// waitRateLimit holds off a flush to endpoint until its rate limit resets, if
+// an earlier response reported it as exhausted, or for at most maxRateLimitWait
+func (c *Collector) waitRateLimit(endpoint string) {
+	c.rateLimitMu.Lock()
+	reset := c.rateLimited[endpoint]
+	c.rateLimitMu.Unlock()
 
-			events[req.stream] = append(events[req.stream], req.events...)
-			numBuffered += len(req.events)
-			if numBuffered >= c.config.BatchSize {
-				flushEvents()
-			}
+	wait := time.Until(reset)
+	if wait <= 0 {
+		return
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
 
-			lg.WithFields(logrus.Fields{
-				"num_events": len(req.events),
-				"stream":     req.stream,
-			}).Debug("Received new events")
-		case <-tick.C:
-			// Flush interval elapsed?
-			if numBuffered > 0 {
-				flushEvents()
-			}
-		case <-c.tomb.Dying():
-			tick.Stop()
+	newEntry(c.logger, Fields{
+		"endpoint": endpoint,
+		"module":   "collector",
+		"reset":    reset,
+	}).Debug("Rate limit exhausted, pausing flush")
 
-			lg.Debug("Shutting down collector...")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.flushCtx.Done():
+	}
+}
 
-			// Drain any remaining messages
-			for req := range c.incoming {
-				events[req.stream] = append(events[req.stream], req.events...)
-				numBuffered += len(req.events)
-			}
+// recordRateLimit remembers when endpoint's rate limit resets if the response
+// reported it as exhausted
+func (c *Collector) recordRateLimit(endpoint string, rl *RateLimit) {
+	if rl == nil || !rl.Exhausted() || time.Until(rl.Reset) > maxRateLimitReset {
+		return
+	}
 
-			if numBuffered > 0 {
-				flushEvents()
-			}
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+	if rl.Reset.After(c.rateLimited[endpoint]) {
+		c.rateLimited[endpoint] = rl.Reset
+	}
+}
 
-			// Wait for all HTTP requests to finish
-			c.wg.Wait()
+// createStreams creates the streams of a batch that haven't already been
+// created, returning whether any were
+func (c *Collector) createStreams(endpoint string, batch *batch) bool {
+	createdAny := false
+	for stream := range batch.events {
+		key := joinURL(endpoint, "/collect/"+stream)
 
-			return nil
+		c.createdMu.Lock()
+		created := c.created[key]
+		c.createdMu.Unlock()
+		if created {
+			continue
 		}
+
+		if err := c.createStream(endpoint, stream); err != nil {
+			continue
+		}
+
+		c.createdMu.Lock()
+		c.created[key] = true
+		c.createdMu.Unlock()
+		createdAny = true
 	}
+
+	return createdAny
 }
 
-// Close shuts down the collector
-func (c *Collector) Close() {
-	c.tomb.Kill(nil)
-	close(c.incoming)
-	c.tomb.Wait()
+func (c *Collector) createStream(endpoint, stream string) error {
+	path := "/collect/" + stream
+	if !isPathValid(http.MethodPost, path) {
+		return ErrInvalidPath
+	}
+
+	lg := newEntry(c.logger, Fields{
+		"endpoint": endpoint,
+		"module":   "collector",
+		"function": "createStream",
+		"stream":   stream,
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, joinURL(endpoint, path), bytes.NewReader([]byte("[]")))
+	req.Header.Add("User-Agent", userAgent(c.config.UserAgent))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	c.auth.Apply(req)
+	req = req.WithContext(c.flushCtx)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.errors.error(lg.WithError(err), "Request to Stride API failed")
+		return ErrRequestFailed
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if err := errorFromStatusCode(res.StatusCode); err != nil {
+		c.errors.error(lg.WithField("status_code", res.StatusCode), "Failed to create stream")
+		return err
+	}
+
+	lg.Debug("Created stream")
+	return nil
 }
 
-// Collect collects events into a stream
-func (c *Collector) Collect(stream string, events ...map[string]interface{}) {
-	c.incoming <- collectRequest{stream, events}
+func (c *Collector) makeRequest(endpoint string, batch *batch) (err error) {
+	lg := newEntry(c.logger, Fields{
+		"endpoint": endpoint,
+		"module":   "collector",
+		"function": "makeRequest",
+	})
+
+	var sum hash.Hash
+	var tee io.Writer
+	if c.config.Checksum {
+		sum = sha256.New()
+		tee = sum
+	}
+	// A dry run logs the uncompressed payload as it's encoded
+	var payload *bytes.Buffer
+	if c.config.DryRun {
+		payload = &bytes.Buffer{}
+		if tee != nil {
+			tee = io.MultiWriter(tee, payload)
+		} else {
+			tee = payload
+		}
+	}
+	var b []byte
+	var pooled *pooledBody
+	var streamed *streamedBody
+	var encoding string
+	var level int
+	if c.config.StreamCompression && !c.config.DisableCompression && tee == nil {
+		encoding, level = "gzip", compressionLevel
+		streamed = newStreamedBody(c.codec, batch.events)
+	} else if !c.config.DisableCompression {
+		encoding, level = "gzip", compressionLevel
+		if pooled, err = compressBody(c.codec, batch.events, tee); err == nil {
+			// The buffer is reused once the request and its response are done
+			defer pooled.release()
+			b = pooled.bytes()
+		}
+	} else {
+		b, err = encodeJSON(c.codec, batch.events, tee)
+	}
+	if err != nil {
+		lg.WithError(err).Error("Failed to encode request body")
+		return ErrInvalidBody
+	}
+	var checksum string
+	if sum != nil {
+		checksum = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	if c.config.DryRun {
+		c.logDryRun(lg, batch, payload.Bytes())
+		return nil
+	}
+
+	url := joinURL(endpoint, "/collect")
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(b))
+	switch {
+	case pooled != nil:
+		req.Body = pooled.reader()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return pooled.reader(), nil
+		}
+	case streamed != nil:
+		// Retries by the transport encode the body again
+		req.Body = streamed.reader()
+		req.GetBody = func() (io.ReadCloser, error) {
+			return streamed.reader(), nil
+		}
+	}
+
+	if encoding != "" {
+		req.Header.Add("Content-Encoding", encoding)
+	}
+	req.Header.Add("User-Agent", userAgent(c.config.UserAgent))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	if streamed == nil {
+		req.Header.Add("Content-Length", fmt.Sprintf("%d", len(b)))
+	}
+	if !batch.deadline.IsZero() {
+		req.Header.Add(DeadlineHeader, batch.deadline.Format(time.RFC3339Nano))
+	}
+	if checksum != "" {
+		req.Header.Add(ChecksumHeader, checksum)
+	}
+	if batch.key != "" {
+		req.Header.Add(IdempotencyKeyHeader, batch.key)
+	}
+	c.auth.Apply(req)
+	req = req.WithContext(c.flushCtx)
+
+	var finish func(int, error)
+	if c.config.Tracer != nil {
+		var ctx context.Context
+		ctx, finish = c.config.Tracer.StartSpan(c.flushCtx, "POST /collect")
+		c.config.Tracer.Inject(ctx, req.Header)
+		req = req.WithContext(ctx)
+	}
+
+	metrics := &RequestMetrics{
+		Method:     http.MethodPost,
+		Path:       "/collect",
+		StatusCode: -1,
+		BytesSent:  len(b),
+
+		ContentEncoding:  encoding,
+		CompressionLevel: level,
+		Checksum:         checksum,
+	}
+	if !batch.flushed.IsZero() {
+		metrics.OldestEventAge = batch.flushed.Sub(batch.oldest)
+		metrics.NewestEventAge = batch.flushed.Sub(batch.newest)
+	}
+	c.lastFlush.Store(metrics)
+	defer func() {
+		if streamed != nil {
+			metrics.BytesSent = streamed.bytesSent()
+		}
+		atomic.AddInt64(&c.bytesSent, int64(metrics.BytesSent))
+		atomic.AddInt64(&c.bytesReceived, int64(metrics.BytesReceived))
+		if c.config.Observer != nil {
+			c.config.Observer(metrics)
+		}
+		if finish != nil {
+			finish(metrics.StatusCode, err)
+		}
+	}()
+
+	res, err := c.client.Do(req)
+	if streamed != nil && streamed.encodeErr() != nil {
+		if err == nil {
+			res.Body.Close()
+		}
+		lg.WithError(streamed.encodeErr()).Error("Failed to encode request body")
+		return ErrInvalidBody
+	}
+	if err != nil {
+		c.errors.error(lg.WithError(err), "Request to Stride API failed")
+		return ErrRequestFailed
+	}
+	defer res.Body.Close()
+
+	metrics.StatusCode = res.StatusCode
+	metrics.RateLimit = parseRateLimit(res.Header)
+	c.recordRateLimit(endpoint, metrics.RateLimit)
+	logCompression(lg, &c.compressionLogged, c.errors, encoding, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	if err == nil {
+		metrics.BytesReceived = len(body)
+	}
+
+	if res.StatusCode == 200 {
+		if c.config.ValidateContentType && !isJSONContentType(res.Header.Get("Content-Type")) {
+			c.errors.error(lg.WithField("content_type", res.Header.Get("Content-Type")),
+				"Collect endpoint returned a non-JSON response, check that the endpoint points at the Stride API")
+			return ErrInvalidResponse
+		}
+		if c.config.OnFlush != nil {
+			c.config.OnFlush(newFlushResult(c.codec, endpoint, batch, body))
+		}
+		return nil
+	}
+
+	c.errors.error(lg.WithField("status_code", res.StatusCode), "Stride API returned invalid status code")
+	return errorFromStatusCode(res.StatusCode)
+}
+
+func (c *Collector) start() error {
+	lg := newEntry(c.logger, Fields{
+		"endpoint": c.config.Endpoint,
+		"module":   "collector",
+	})
+
+	buffered := newBatch()
+
+	// Either tick every FlushInterval, or at the end of each window
+	var tick *time.Ticker
+	var window *time.Timer
+	var windowEnd time.Time
+	var flushC <-chan time.Time
+	flushInterval := c.config.FlushInterval
+	if c.config.Window > 0 {
+		windowEnd = c.windowEnd(time.Now())
+		window = time.NewTimer(time.Until(windowEnd))
+		flushC = window.C
+	} else {
+		tick = time.NewTicker(flushInterval)
+		flushC = tick.C
+	}
+
+	// Retunes the ticker after every tick if AdaptiveFlush is set, based on
+	// the number of events received since the last one
+	var adaptive *adaptiveInterval
+	var received int
+	if c.config.AdaptiveFlush && tick != nil {
+		adaptive = newAdaptiveInterval(c.config)
+	}
+
+	// Armed when the first event of a batch is buffered, if MaxBufferAge is set
+	var ageTimer *time.Timer
+	var ageC <-chan time.Time
+	stopAgeTimer := func() {
+		if ageTimer != nil {
+			ageTimer.Stop()
+			ageTimer = nil
+			ageC = nil
+		}
+	}
+
+	// Fires once InitialDelay elapses, flushing whatever the ticker held back
+	var initialC <-chan time.Time
+	if c.config.InitialDelay > 0 && window == nil {
+		initial := time.NewTimer(c.config.InitialDelay)
+		defer initial.Stop()
+		initialC = initial.C
+	}
+
+	var lifetimeC <-chan time.Time
+	if c.config.MaxLifetime > 0 {
+		lifetime := time.NewTimer(c.config.MaxLifetime)
+		defer lifetime.Stop()
+		lifetimeC = lifetime.C
+	}
+
+	// Cleared once the context is done, since Done stays ready afterwards
+	ctxDone := c.ctx.Done()
+
+	lg.Debug("Starting collector...")
+
+	// Closed once the most recent flush and every flush before it completed
+	var flushed chan struct{}
+	var lastFlushed time.Time
+
+	// flushEvents sends the buffered events, and then the error of the request
+	// to result if it's non-nil, once every earlier flush completed too
+	flushEvents := func(result chan<- error) {
+		prev := flushed
+		if buffered.size == 0 {
+			if result != nil {
+				go func() {
+					if prev != nil {
+						<-prev
+					}
+					result <- nil
+				}()
+			}
+			return
+		}
+
+		done := make(chan struct{})
+		flushed = done
+		lastFlushed = time.Now()
+
+		c.semaphone <- true
+		c.wg.Add(1)
+
+		lg.WithFields(Fields{
+			"num_events":  buffered.size,
+			"num_streams": len(buffered.events),
+		}).Debug("Flushing events to server")
+
+		buffered.flushed = time.Now()
+		c.recordLatency(buffered.flushed.Sub(buffered.oldest))
+
+		go func(batch *batch) {
+			err := c.send(batch)
+			c.wg.Done()
+			<-c.semaphone
+
+			if prev != nil {
+				<-prev
+			}
+			close(done)
+			if result != nil {
+				result <- err
+			}
+		}(buffered)
+
+		// Reset
+		buffered = newBatch()
+		atomic.StoreInt64(&c.buffered, 0)
+		stopAgeTimer()
+	}
+
+	// buffer adds the events of req to the batch, deduplicating them if
+	// DedupeByID is set, and flushes it once it's full
+	buffer := func(req collectRequest, now time.Time) {
+		if c.config.DedupeByID {
+			var codec Codec
+			if c.config.MaxBatchBytes > 0 {
+				codec = c.codec
+			}
+			atomic.AddInt64(&c.deduplicated, int64(buffered.addDeduped(req, now, codec)))
+		} else {
+			buffered.add(req, now)
+		}
+		atomic.StoreInt64(&c.buffered, int64(buffered.size))
+
+		if buffered.size >= c.config.BatchSize ||
+			(c.config.MaxBatchBytes > 0 && buffered.bytes >= c.config.MaxBatchBytes) {
+			flushEvents(nil)
+		}
+	}
+
+	// receive buffers events taken from incoming
+	receive := func(req collectRequest) {
+		now := time.Now()
+		received += req.size()
+
+		// Don't let events spill into a window whose timer hasn't fired yet
+		if window != nil && !now.Before(windowEnd) {
+			if buffered.size > 0 {
+				flushEvents(nil)
+			}
+			windowEnd = c.windowEnd(now)
+			window.Reset(time.Until(windowEnd))
+		}
+
+		// Bound the number of buffered streams
+		if c.config.MaxStreams > 0 {
+			streams := len(buffered.events)
+			req.each(func(stream string, _ []map[string]interface{}) {
+				if _, ok := buffered.events[stream]; !ok {
+					streams++
+				}
+			})
+			if streams > c.config.MaxStreams && streams > len(buffered.events) {
+				flushEvents(nil)
+			}
+		}
+
+		// Flush first if the events would push the batch past MaxBatchBytes,
+		// unless it's empty so that oversized events are sent on their own
+		if c.config.MaxBatchBytes > 0 && buffered.size > 0 &&
+			buffered.bytes+req.bytes > c.config.MaxBatchBytes {
+			flushEvents(nil)
+		}
+
+		if ageTimer == nil && c.config.MaxBufferAge > 0 {
+			ageTimer = time.NewTimer(c.config.MaxBufferAge)
+			ageC = ageTimer.C
+		}
+
+		buffer(req, now)
+
+		lg.WithFields(Fields{
+			"num_events":  req.size(),
+			"num_streams": len(req.streams),
+			"stream":      req.stream,
+		}).Debug("Received new events")
+	}
+
+	for {
+		select {
+		case req, ok := <-c.incoming:
+			if !ok {
+				break
+			}
+			receive(req)
+		case result := <-c.flushes:
+			// Take in everything collected before Flush was called
+			for drained := false; !drained; {
+				select {
+				case req, ok := <-c.incoming:
+					if ok {
+						receive(req)
+					} else {
+						drained = true
+					}
+				default:
+					drained = true
+				}
+			}
+			flushEvents(result)
+		case <-flushC:
+			// Flush interval elapsed or window ended? Hold off until InitialDelay
+			// has elapsed, and skip ticks right after another flush, e.g. one
+			// triggered by BatchSize, leaving the few events buffered since for
+			// the next tick.
+			debounced := tick != nil && time.Since(lastFlushed) < flushInterval/flushDebounce
+			if buffered.size > 0 && initialC == nil && !debounced {
+				flushEvents(nil)
+			}
+			if window != nil {
+				windowEnd = c.windowEnd(time.Now())
+				window.Reset(time.Until(windowEnd))
+			}
+			if adaptive != nil {
+				if next := adaptive.next(received); next != flushInterval {
+					lg.WithFields(Fields{
+						"from": flushInterval,
+						"to":   next,
+					}).Debug("Adapted flush interval")
+					flushInterval = next
+					tick.Stop()
+					tick = time.NewTicker(flushInterval)
+					flushC = tick.C
+				}
+				received = 0
+			}
+		case <-initialC:
+			initialC = nil
+			if buffered.size > 0 {
+				flushEvents(nil)
+			}
+		case <-ageC:
+			// Oldest buffered event exceeded MaxBufferAge
+			ageTimer = nil
+			ageC = nil
+			if buffered.size > 0 {
+				flushEvents(nil)
+			}
+		case <-lifetimeC:
+			lifetimeC = nil
+			lg.Debug("Collector reached its MaxLifetime")
+			c.shutdown()
+		case <-ctxDone:
+			ctxDone = nil
+			lg.WithError(c.ctx.Err()).Debug("Collector context done")
+			c.shutdown()
+		case <-c.tomb.Dying():
+			if tick != nil {
+				tick.Stop()
+			}
+			if window != nil {
+				window.Stop()
+			}
+			stopAgeTimer()
+
+			lg.Debug("Shutting down collector...")
+
+			// Drain any remaining messages. shutdown closes incoming once no
+			// more events can be enqueued, so this sees every collected event
+			// exactly once, unless DrainTimeout elapses first.
+			c.drain(func(req collectRequest) {
+				buffer(req, time.Now())
+			})
+
+			if buffered.size > 0 {
+				flushEvents(nil)
+			}
+
+			// Wait for all HTTP requests to finish
+			c.wg.Wait()
+			c.cancelFlush()
+			c.errors.flush()
+
+			if c.config.LogSummary {
+				stats := c.Stats()
+				lg.WithFields(Fields{
+					"collected":  stats.Collected,
+					"delivered":  stats.Delivered,
+					"failed":     stats.Failed,
+					"dropped":    stats.Dropped,
+					"bytes_sent": stats.BytesSent,
+					"uptime":     stats.Uptime,
+				}).Info("Collector shut down")
+			}
+
+			if c.recorder != nil {
+				c.recorder.close()
+			}
+
+			return nil
+		}
+	}
+}
+
+// drain passes the requests left in incoming to f until shutdown closed it, or
+// DrainTimeout elapsed. Requests not drained in time are counted as dropped,
+// and spilled if SpillPath is set, before drain returns. That doesn't wait on
+// anything but shutdown closing incoming, which it does right after killing
+// the tomb.
+func (c *Collector) drain(f func(req collectRequest)) {
+	var timeout <-chan time.Time
+	if c.config.DrainTimeout > 0 {
+		timer := time.NewTimer(c.config.DrainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case req, ok := <-c.incoming:
+			if !ok {
+				return
+			}
+			f(req)
+		case <-timeout:
+			newEntry(c.logger, Fields{
+				"module":  "collector",
+				"timeout": c.config.DrainTimeout,
+			}).Warn("Timed out draining collected events")
+			for req := range c.incoming {
+				atomic.AddInt64(&c.dropped, int64(req.size()))
+				if c.spiller != nil {
+					c.spiller.spill(req)
+				}
+			}
+			return
+		}
+	}
+}
+
+// windowEnd returns the end of the flush window containing t
+func (c *Collector) windowEnd(t time.Time) time.Time {
+	return t.Add(-c.config.WindowOffset).Truncate(c.config.Window).Add(c.config.Window + c.config.WindowOffset)
+}
+
+// adaptiveInterval is the flush interval of a collector with AdaptiveFlush
+type adaptiveInterval struct {
+	interval  time.Duration
+	min       time.Duration
+	max       time.Duration
+	batchSize int
+
+	// Moving average of how much of a batch each interval's events filled
+	fill float64
+}
+
+func newAdaptiveInterval(config *CollectorConfig) *adaptiveInterval {
+	a := &adaptiveInterval{
+		interval:  config.FlushInterval,
+		min:       config.MinFlushInterval,
+		max:       config.MaxFlushInterval,
+		batchSize: config.BatchSize,
+	}
+	if a.min <= 0 {
+		a.min = config.FlushInterval / adaptiveRange
+	}
+	if a.max <= 0 {
+		a.max = config.FlushInterval * adaptiveRange
+	}
+	return a
+}
+
+// next returns the interval until the next flush, given the number of events
+// collected during the interval that just ended
+func (a *adaptiveInterval) next(received int) time.Duration {
+	fill := 1.0
+	if a.batchSize > 0 && received < a.batchSize {
+		fill = float64(received) / float64(a.batchSize)
+	}
+	a.fill = (a.fill + fill) / 2
+
+	switch {
+	case a.fill >= adaptiveHighFill:
+		a.interval /= 2
+		if a.interval < a.min {
+			a.interval = a.min
+		}
+	case a.fill < adaptiveLowFill:
+		a.interval *= 2
+		if a.interval > a.max {
+			a.interval = a.max
+		}
+	}
+	return a.interval
+}
+
+// SelfTest synchronously sends a single synthetic event to SelfTestStream,
+// bypassing the collector's buffer, and returns an error if the server didn't
+// accept it. It exercises the same serialization, compression and
+// authentication as regular flushes. Note that this writes a real event, so
+// SelfTestStream must exist and should be treated as disposable.
+func (c *Collector) SelfTest() error {
+	event := map[string]interface{}{
+		"client":  "gostride",
+		"version": Version,
+	}
+	SetTimestamp(event, time.Now())
+
+	b := newBatch()
+	b.add(collectRequest{stream: SelfTestStream, events: []map[string]interface{}{event}}, time.Now())
+
+	return c.flush(b)
+}
+
+// Endpoint returns the endpoint the collector flushes to
+func (c *Collector) Endpoint() string {
+	return c.config.Endpoint
+}
+
+// FlushResult is the outcome of a successful flush, as reported by the server
+type FlushResult struct {
+	Endpoint string
+	Streams  map[string]StreamResult
+}
+
+// StreamResult is how many of a stream's events in a flushed batch the server
+// accepted and rejected. If the server didn't report on the stream, all of its
+// events are counted as accepted.
+type StreamResult struct {
+	Accepted int
+	Rejected int
+
+	// Errors are the reasons the server gave for rejecting events, if any
+	Errors []RejectedEvent
+}
+
+// RejectedEvent is an event the server rejected, identified by its index among
+// its stream's events in the batch
+type RejectedEvent struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// newFlushResult parses a collect response of the form
+// {"stream": {"accepted": 2, "rejected": 1, "errors": [{"index": 0, "error": "..."}]}}
+// with the codec
+func newFlushResult(codec Codec, endpoint string, batch *batch, body []byte) FlushResult {
+	var reported map[string]struct {
+		Accepted *int            `json:"accepted"`
+		Rejected int             `json:"rejected"`
+		Errors   []RejectedEvent `json:"errors"`
+	}
+	codec.Unmarshal(body, &reported)
+
+	result := FlushResult{Endpoint: endpoint, Streams: make(map[string]StreamResult, len(batch.events))}
+	for stream, events := range batch.events {
+		sr := StreamResult{Accepted: len(events)}
+		if r, ok := reported[stream]; ok {
+			sr.Rejected = r.Rejected
+			sr.Errors = r.Errors
+			if r.Accepted != nil {
+				sr.Accepted = *r.Accepted
+			} else {
+				sr.Accepted = len(events) - r.Rejected
+			}
+		}
+		result.Streams[stream] = sr
+	}
+	return result
+}
+
+// maxConcurrentRequests returns the configured MaxConcurrentRequests, or its
+// default
+func maxConcurrentRequests(config *CollectorConfig) int {
+	switch {
+	case config.MaxConcurrentRequests < 0:
+		panic(fmt.Sprintf("stride: MaxConcurrentRequests must be at least 1, got %d", config.MaxConcurrentRequests))
+	case config.MaxConcurrentRequests == 0:
+		return maxReqsInFlight
+	}
+	return config.MaxConcurrentRequests
+}
+
+// newCollectorTransport returns the transport of a collector that isn't
+// configured with one. It's tuned to reuse connections across flushes, and
+// negotiates HTTP/2 with endpoints that support it, so that concurrent flushes
+// share a connection.
+func newCollectorTransport(rootCAs *x509.CertPool) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if rootCAs != nil {
+		t.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	return t
+}
+
+// VerifyError is returned by Verify when the collector can't deliver events.
+// Err is ErrRequestFailed if the endpoint is unreachable, ErrInvalidAPIKey if
+// the credentials were rejected, or the error for any other failed response.
+// Cause is the underlying transport error, if any.
+type VerifyError struct {
+	Endpoint string
+	Err      error
+	Cause    error
+}
+
+func (e *VerifyError) Error() string {
+	switch {
+	case e.Cause != nil:
+		return fmt.Sprintf("Stride API at %s is unreachable: %s", e.Endpoint, e.Cause)
+	case e.Err == ErrInvalidAPIKey:
+		return fmt.Sprintf("Stride API at %s rejected the API key", e.Endpoint)
+	default:
+		return fmt.Sprintf("Stride API at %s failed verification: %s", e.Endpoint, e.Err)
+	}
+}
+
+// Verify checks that the endpoint is reachable and accepts the collector's API
+// key, returning a *VerifyError if not, or the context's error if ctx is done
+// first. Unlike SelfTest it doesn't write any events, so it's suitable for
+// frequent readiness probes.
+func (c *Collector) Verify(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, joinURL(c.config.Endpoint, "/collect"), nil)
+	if err != nil {
+		return &VerifyError{Endpoint: c.config.Endpoint, Err: ErrRequestFailed, Cause: err}
+	}
+	req.Header.Add("User-Agent", userAgent(c.config.UserAgent))
+	req.Header.Add("Accept", "application/json")
+	c.auth.Apply(req)
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &VerifyError{Endpoint: c.config.Endpoint, Err: ErrRequestFailed, Cause: err}
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if err := errorFromStatusCode(res.StatusCode); err != nil {
+		return &VerifyError{Endpoint: c.config.Endpoint, Err: err}
+	}
+	return nil
+}
+
+func (c *Collector) recordResult(err error) {
+	if err != nil {
+		atomic.AddInt32(&c.failures, 1)
+	} else {
+		atomic.StoreInt32(&c.failures, 0)
+	}
+}
+
+// isDegraded returns whether enough consecutive flushes have failed for Collect
+// to fall back to synchronous sends
+func (c *Collector) isDegraded() bool {
+	return c.config.FallbackThreshold > 0 &&
+		atomic.LoadInt32(&c.failures) >= int32(c.config.FallbackThreshold)
+}
+
+// sendSync attempts to synchronously send a request, retrying on failure
+func (c *Collector) sendSync(req collectRequest) error {
+	b := newBatch()
+	b.add(req, time.Now())
+
+	var err error
+	for i := 0; i <= c.config.FallbackRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(c.config.FlushInterval):
+			case <-c.tomb.Dying():
+				return err
+			}
+		}
+
+		err = c.flush(b)
+		c.recordResult(err)
+		if err == nil {
+			c.recordDelivery(b.size, nil)
+			return nil
+		}
+	}
+
+	return err
+}
+
+// send flushes a batch and accounts for its outcome
+func (c *Collector) send(batch *batch) error {
+	err := c.flush(batch)
+	if err != nil && c.deadLetters != nil {
+		c.deadLetters.add(batch, err)
+	}
+	if err != nil && c.spiller != nil && !c.tomb.Alive() {
+		c.spiller.spill(collectRequest{
+			streams:   batch.events,
+			deadline:  batch.deadline,
+			endpoints: failedEndpoints(err),
+		})
+	}
+	if err != nil && c.config.OnError != nil {
+		for stream, events := range batch.events {
+			c.config.OnError(stream, events, err)
+		}
+	}
+	c.recordResult(err)
+	c.recordDelivery(batch.size, err)
+
+	return err
+}
+
+// partialBatch returns a batch of the events of req, recovered from a flush
+// that failed for only some endpoints, that's only sent to those
+func (c *Collector) partialBatch(req collectRequest) *batch {
+	b := newBatch()
+	b.add(req, time.Now())
+	b.sent = make(map[string]bool)
+	for _, endpoint := range c.endpoints() {
+		b.sent[endpoint] = true
+	}
+	for _, endpoint := range req.endpoints {
+		delete(b.sent, endpoint)
+	}
+	return b
+}
+
+// recordDelivery counts the events of a flushed batch as delivered or failed
+func (c *Collector) recordDelivery(events int, err error) {
+	atomic.AddInt64(&c.batches, 1)
+	if err != nil {
+		atomic.AddInt64(&c.failedBatches, 1)
+		atomic.AddInt64(&c.failed, int64(events))
+	} else {
+		atomic.AddInt64(&c.delivered, int64(events))
+	}
+}
+
+func (c *Collector) recordLatency(latency time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && latency > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&c.latency[i], 1)
+}
+
+// Stats returns a snapshot of the collector's cumulative statistics
+func (c *Collector) Stats() CollectorStats {
+	stats := CollectorStats{
+		Collected:      atomic.LoadInt64(&c.collected),
+		Delivered:      atomic.LoadInt64(&c.delivered),
+		Failed:         atomic.LoadInt64(&c.failed),
+		Dropped:        atomic.LoadInt64(&c.dropped),
+		Deduplicated:   atomic.LoadInt64(&c.deduplicated),
+		Buffered:       atomic.LoadInt64(&c.buffered),
+		Batches:        atomic.LoadInt64(&c.batches),
+		FailedBatches:  atomic.LoadInt64(&c.failedBatches),
+		InFlight:       len(c.semaphone),
+		Uptime:         time.Since(c.started),
+		BytesSent:      atomic.LoadInt64(&c.bytesSent),
+		BytesReceived:  atomic.LoadInt64(&c.bytesReceived),
+		BlockedTime:    time.Duration(atomic.LoadInt64(&c.blockedTime)),
+		LatencyBuckets: append([]time.Duration(nil), latencyBuckets[:]...),
+		Latency:        make([]int64, len(c.latency)),
+	}
+	for i := range c.latency {
+		stats.Latency[i] = atomic.LoadInt64(&c.latency[i])
+	}
+	if m, ok := c.lastFlush.Load().(*RequestMetrics); ok {
+		stats.LastFlushEncoding = m.ContentEncoding
+		stats.LastFlushCompressionLevel = m.CompressionLevel
+	}
+
+	return stats
+}
+
+// Close shuts down the collector
+func (c *Collector) Close() {
+	c.shutdown()
+	c.tomb.Wait()
+}
+
+// CloseError is returned by CloseContext when ctx is done before the collector
+// finished shutting down. It unwraps to ctx's error.
+type CloseError struct {
+	Err error
+
+	// Events that were still buffered or being sent, and the requests in flight
+	Pending  int64
+	InFlight int
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("Collector shutdown incomplete with %d events pending in %d requests: %s", e.Pending, e.InFlight, e.Err)
+}
+
+// Unwrap returns ctx's error
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// CloseContext shuts down the collector like Close, but stops waiting once ctx
+// is done. The flushes still in flight are then aborted, and a *CloseError is
+// returned with the number of events that weren't sent yet.
+func (c *Collector) CloseContext(ctx context.Context) error {
+	c.shutdown()
+	select {
+	case <-c.tomb.Dead():
+		return nil
+	case <-ctx.Done():
+	}
+
+	stats := c.Stats()
+	err := &CloseError{
+		Err:      ctx.Err(),
+		Pending:  stats.Collected - stats.Delivered - stats.Failed - stats.Dropped - stats.Deduplicated,
+		InFlight: stats.InFlight,
+	}
+	c.cancelFlush()
+	return err
+}
+
+// SetAPIKey replaces the API key that the collector authenticates with, e.g. to
+// rotate it without restarting. It takes effect from the next request, and is
+// safe to call concurrently with Collect. The key is unused if the config's
+// Auth is set.
+func (c *Collector) SetAPIKey(apiKey string) {
+	c.auth.setKey(apiKey)
+}
+
+// Flush immediately sends the events collected so far, and returns once they
+// have been sent along with the error of the request, if any. Flushes already
+// in flight are waited for too, but their errors aren't reported. If the
+// collector is shutting down Flush waits for the shutdown to complete instead.
+// It's safe to call concurrently with Collect.
+func (c *Collector) Flush() error {
+	result := make(chan error, 1)
+	select {
+	case c.flushes <- result:
+		return <-result
+	case <-c.tomb.Dying():
+		c.tomb.Wait()
+		return nil
+	}
+}
+
+// shutdown stops the collector from accepting events and closes incoming so
+// that the remaining events can be drained. It is safe to call more than once.
+func (c *Collector) shutdown() {
+	// Wake up any Collect calls blocked on a full buffer first, so that we
+	// don't wait on them to acquire closeMu
+	c.tomb.Kill(nil)
+
+	if c.config.FlushOnSignal {
+		unwatchSignals(c)
+	}
+
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.incoming)
+	}
+}
+
+// Collect collects events into a stream. Events collected after the collector
+// has shut down are discarded and ErrCollectorClosed is returned. If the
+// collector is Synchronous, the events are sent immediately and the error of
+// the request, if any, is returned.
+func (c *Collector) Collect(stream string, events ...map[string]interface{}) error {
+	return c.enqueue(collectRequest{stream: stream, events: events})
+}
+
+// CollectWithDeadline collects events into a stream, hinting to the server
+// that they should be processed by the given deadline. The hint is sent in the
+// DeadlineHeader of the batch the events are flushed in, which carries the
+// earliest deadline of all of its events.
+func (c *Collector) CollectWithDeadline(stream string, deadline time.Time, events ...map[string]interface{}) error {
+	return c.enqueue(collectRequest{stream: stream, events: events, deadline: deadline})
+}
+
+// CollectBatch collects events into several streams at once, keyed by stream.
+// It's equivalent to calling Collect for each stream, but takes a single slot
+// of the collector's buffer.
+func (c *Collector) CollectBatch(events map[string][]map[string]interface{}) error {
+	// Copy the map, since it's only read once the events are buffered
+	streams := make(map[string][]map[string]interface{}, len(events))
+	for stream, e := range events {
+		if len(e) > 0 {
+			streams[stream] = e
+		}
+	}
+	if len(streams) == 0 {
+		return nil
+	}
+	return c.enqueue(collectRequest{streams: streams})
+}
+
+func (c *Collector) enqueue(req collectRequest) error {
+	size := req.size()
+	atomic.AddInt64(&c.collected, int64(size))
+	if c.isClosed() {
+		atomic.AddInt64(&c.dropped, int64(size))
+		return ErrCollectorClosed
+	}
+
+	var invalid error
+	if c.config.ValidateEvents {
+		if req.streams == nil {
+			req.events, invalid = c.validate(req.stream, req.events)
+		} else {
+			for stream, events := range req.streams {
+				valid, err := c.validate(stream, events)
+				if invalid == nil {
+					invalid = err
+				}
+				if len(valid) > 0 {
+					req.streams[stream] = valid
+				} else {
+					delete(req.streams, stream)
+				}
+			}
+		}
+		if size = req.size(); size == 0 {
+			return invalid
+		}
+	}
+
+	if c.recorder != nil {
+		c.recorder.record(req)
+	}
+
+	if c.config.MaxBatchBytes > 0 {
+		req.each(func(_ string, events []map[string]interface{}) {
+			req.bytes += eventBytes(c.codec, events)
+		})
+	}
+
+	if c.config.Synchronous {
+		b := newBatch()
+		b.add(req, time.Now())
+		if err := c.send(b); err != nil {
+			return err
+		}
+		return invalid
+	}
+
+	if c.isDegraded() && c.sendSync(req) == nil {
+		return invalid
+	}
+
+	if err := c.push(req); err != nil {
+		return err
+	}
+	return invalid
+}
+
+// isClosed reports whether shutdown has been called
+func (c *Collector) isClosed() bool {
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+	return c.closed
+}
+
+// push sends a request to incoming, blocking while it's full. closeMu is only
+// held for the send itself, so that shutdown never waits on a synchronous
+// flush, and blocked sends give up as soon as the collector is dying.
+func (c *Collector) push(req collectRequest) error {
+	// Hold closeMu so that incoming isn't closed while we're sending to it
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+
+	if c.closed {
+		atomic.AddInt64(&c.dropped, int64(req.size()))
+		return ErrCollectorClosed
+	}
+
+	select {
+	case c.incoming <- req:
+		return nil
+	default:
+	}
+
+	// The buffer is full, so the collector isn't keeping up
+	start := time.Now()
+	var err error
+	select {
+	case c.incoming <- req:
+	case <-c.tomb.Dying():
+		atomic.AddInt64(&c.dropped, int64(req.size()))
+		err = ErrCollectorClosed
+	}
+	c.recordBlocked(time.Since(start))
+	return err
+}
+
+// validate splits off the invalid events of a Collect call, counting them as
+// failed and passing them to OnError. The returned error is a *BodyError for
+// the first invalid event.
+func (c *Collector) validate(stream string, events []map[string]interface{}) ([]map[string]interface{}, error) {
+	var first error
+	var valid []map[string]interface{}
+	for i, event := range events {
+		path, err := validateEvent(c.codec, event)
+		if err == nil {
+			if valid != nil {
+				valid = append(valid, event)
+			}
+			continue
+		}
+
+		if valid == nil {
+			// Copy rather than filter in place, since events is the caller's
+			valid = append(make([]map[string]interface{}, 0, len(events)-1), events[:i]...)
+		}
+		if e, ok := err.(*BodyError); ok {
+			err = e.Err
+		}
+		err = &BodyError{Path: fmt.Sprintf("[%d].%s", i, path), Err: err}
+		if first == nil {
+			first = err
+		}
+		atomic.AddInt64(&c.failed, 1)
+		if c.config.OnError != nil {
+			c.config.OnError(stream, []map[string]interface{}{event}, err)
+		}
+	}
+
+	if first == nil {
+		return events, nil
+	}
+	return valid, first
+}
+
+func (c *Collector) recordBlocked(blocked time.Duration) {
+	atomic.AddInt64(&c.blockedTime, int64(blocked))
+
+	if c.config.BlockedWarnThreshold <= 0 || blocked < c.config.BlockedWarnThreshold {
+		return
+	}
+
+	c.errors.warn(newEntry(c.logger, Fields{
+		"endpoint": c.config.Endpoint,
+		"module":   "collector",
+		"blocked":  blocked,
+	}), "Collect blocked on a full buffer, the collector can't keep up")
 }
@@ -2,11 +2,23 @@ package stride
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,23 +31,26 @@ type CollectorTestSuite struct {
 }
 
 type mockRequest struct {
-	time time.Time
-	body map[string]interface{}
+	time   time.Time
+	header http.Header
+	body   map[string]interface{}
 }
 
 func createMockCollectServer() (*httptest.Server, chan mockRequest) {
 	rchan := make(chan mockRequest, 1)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		gz, _ := gzip.NewReader(r.Body)
-		r.Body = gz
-		defer gz.Close()
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, _ := gzip.NewReader(r.Body)
+			r.Body = gz
+			defer gz.Close()
+		}
 		body, _ := ioutil.ReadAll(r.Body)
 
 		var v map[string]interface{}
 		json.Unmarshal(body, &v)
 
-		rchan <- mockRequest{time.Now(), v}
+		rchan <- mockRequest{time.Now(), r.Header, v}
 	}))
 
 	return server, rchan
@@ -52,6 +67,123 @@ func (suite *CollectorTestSuite) TestEventFuncs() {
 	assert.Equal(suite.T(), "2016-09-12T09:00:00-04:00", event[Timestamp])
 }
 
+func (suite *CollectorTestSuite) TestValidateEvent() {
+	event := map[string]interface{}{"name": "Mr. Peanutbutter"}
+	assert.Nil(suite.T(), ValidateEvent(event))
+
+	SetID(event, "labrador")
+	SetTimestamp(event, time.Now())
+	assert.Nil(suite.T(), ValidateEvent(event))
+
+	event[Timestamp] = time.Now()
+	assert.Nil(suite.T(), ValidateEvent(event))
+
+	event[Timestamp] = "yesterday"
+	assert.Equal(suite.T(), ErrInvalidTimestamp, ValidateEvent(event))
+	event[Timestamp] = 1475533191
+	assert.Equal(suite.T(), ErrInvalidTimestamp, ValidateEvent(event))
+	delete(event, Timestamp)
+
+	event[ID] = ""
+	assert.Equal(suite.T(), ErrInvalidID, ValidateEvent(event))
+	event[ID] = 42
+	assert.Equal(suite.T(), ErrInvalidID, ValidateEvent(event))
+	delete(event, ID)
+
+	event["$ttl"] = 10
+	assert.Equal(suite.T(), ErrReservedKey, ValidateEvent(event))
+	delete(event, "$ttl")
+
+	event["callback"] = func() {}
+	err := ValidateEvent(event)
+	assert.True(suite.T(), errors.Is(err, ErrInvalidBody))
+	assert.Equal(suite.T(), "callback", err.(*BodyError).Path)
+}
+
+func (suite *CollectorTestSuite) TestCollectBatch() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.Endpoint = server.URL
+	config.ValidateEvents = true
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Pinky Penguin"}
+	assert.Nil(suite.T(), collector.Collect("s0", event))
+	assert.Nil(suite.T(), collector.CollectBatch(map[string][]map[string]interface{}{
+		"s0": {event, event},
+		"s1": {event},
+		"s2": {},
+	}))
+	err := collector.CollectBatch(map[string][]map[string]interface{}{
+		"s1": {event, {ID: 1}},
+		"s3": {{ID: 2}},
+	})
+	assert.True(suite.T(), errors.Is(err, ErrInvalidID))
+	assert.Nil(suite.T(), collector.CollectBatch(nil))
+	collector.Close()
+
+	e := map[string]interface{}{"name": "Pinky Penguin"}
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{e, e, e},
+		"s1": []interface{}{e, e},
+	}, (<-rchan).body)
+
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(7), stats.Collected)
+	assert.Equal(suite.T(), int64(5), stats.Delivered)
+	assert.Equal(suite.T(), int64(2), stats.Failed)
+}
+
+func (suite *CollectorTestSuite) TestCollectInvalid() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	var invalid []error
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.ValidateEvents = true
+	config.OnError = func(stream string, events []map[string]interface{}, err error) {
+		assert.Equal(suite.T(), "s0", stream)
+		assert.Equal(suite.T(), 1, len(events))
+		invalid = append(invalid, err)
+	}
+
+	collector := NewCollector("deadbeef", config)
+	good := map[string]interface{}{"name": "Diane Nguyen"}
+	events := []map[string]interface{}{
+		good,
+		{"name": "Todd", "updates": make(chan int)},
+		{Timestamp: "yesterday"},
+		good,
+	}
+	err := collector.Collect("s0", events...)
+	assert.Equal(suite.T(), "Invalid request body at [1].updates: json: unsupported type: chan int", err.Error())
+	assert.True(suite.T(), errors.Is(err, ErrInvalidBody))
+	assert.Equal(suite.T(), 2, len(invalid))
+	assert.True(suite.T(), errors.Is(invalid[1], ErrInvalidTimestamp))
+	assert.Equal(suite.T(), "[2].$timestamp", invalid[1].(*BodyError).Path)
+	assert.Equal(suite.T(), 4, len(events))
+
+	err = collector.Collect("s0", map[string]interface{}{"$ttl": 1})
+	assert.True(suite.T(), errors.Is(err, ErrReservedKey))
+	collector.Close()
+
+	req := <-rchan
+	assert.Equal(suite.T(), 2, len(req.body["s0"].([]interface{})))
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(2), stats.Delivered)
+	assert.Equal(suite.T(), int64(3), stats.Failed)
+
+	config.ValidateEvents = false
+	collector = NewCollector("deadbeef", config)
+	assert.Nil(suite.T(), collector.Collect("s0", map[string]interface{}{"$ttl": 1}))
+	collector.Close()
+	<-rchan
+}
+
 func (suite *CollectorTestSuite) TestCollector() {
 	server, rchan := createMockCollectServer()
 	defer server.Close()
@@ -102,6 +234,1481 @@ func (suite *CollectorTestSuite) TestCollector() {
 	}, request.body)
 }
 
+func (suite *CollectorTestSuite) TestMaxBufferAge() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.MaxBufferAge = 100 * time.Millisecond
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Princess Carolyn"}
+
+	startTime := time.Now()
+	collector.Collect("s0", event)
+
+	select {
+	case request := <-rchan:
+		assert.True(suite.T(), time.Since(startTime) >= config.MaxBufferAge)
+		assert.Equal(suite.T(), map[string]interface{}{
+			"s0": []interface{}{event},
+		}, request.body)
+	case <-time.After(2 * time.Second):
+		suite.T().Fatal("events were not flushed after MaxBufferAge")
+	}
+}
+
+func (suite *CollectorTestSuite) TestInitialDelay() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Millisecond
+	config.InitialDelay = 200 * time.Millisecond
+	config.Endpoint = server.URL
+
+	startTime := time.Now()
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Diane Nguyen"}
+	for i := 0; i < 3; i++ {
+		collector.Collect("s0", event)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case request := <-rchan:
+		assert.True(suite.T(), time.Since(startTime) >= config.InitialDelay)
+		assert.Equal(suite.T(), 3, len(request.body["s0"].([]interface{})))
+	case <-time.After(2 * time.Second):
+		suite.T().Fatal("events were not flushed after InitialDelay")
+	}
+
+	// The interval applies once InitialDelay has elapsed
+	startTime = time.Now()
+	collector.Collect("s0", event)
+	<-rchan
+	assert.True(suite.T(), time.Since(startTime) < config.InitialDelay)
+}
+
+func (suite *CollectorTestSuite) TestFlush() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+
+	// Nothing to flush
+	assert.Nil(suite.T(), collector.Flush())
+
+	event := map[string]interface{}{"name": "Hollyhock"}
+	collector.Collect("s0", event)
+	collector.Collect("s1", event, event)
+	assert.Nil(suite.T(), collector.Flush())
+
+	// The request has completed by the time Flush returns
+	select {
+	case request := <-rchan:
+		assert.Equal(suite.T(), map[string]interface{}{
+			"s0": []interface{}{event},
+			"s1": []interface{}{event, event},
+		}, request.body)
+	default:
+		suite.T().Fatal("events were not flushed by Flush")
+	}
+
+	// Collecting continues afterward
+	collector.Collect("s0", event)
+	collector.Close()
+	assert.Equal(suite.T(), 1, len((<-rchan).body["s0"].([]interface{})))
+
+	assert.Nil(suite.T(), collector.Flush())
+}
+
+func (suite *CollectorTestSuite) TestFlushError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				collector.Collect("s0", map[string]interface{}{"j": j})
+			}
+		}()
+	}
+
+	collector.Collect("s0", map[string]interface{}{"name": "Beatrice"})
+	assert.Equal(suite.T(), ErrInvalidAPIKey, collector.Flush())
+	wg.Wait()
+}
+
+func (suite *CollectorTestSuite) TestOnError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	failed := make(map[string]int)
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.OnError = func(stream string, events []map[string]interface{}, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(suite.T(), ErrServerError, err)
+		failed[stream] += len(events)
+	}
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Wanda Pierce"}
+	collector.Collect("s0", event, event)
+	collector.Collect("s1", event)
+	collector.Close()
+
+	assert.Equal(suite.T(), map[string]int{"s0": 2, "s1": 1}, failed)
+}
+
+func (suite *CollectorTestSuite) TestOnFlush() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"s0": {"accepted": 1, "rejected": 1, "errors": [{"index": 1, "error": "bad value"}]}, "s1": {"accepted": 1}}`))
+	}))
+	defer server.Close()
+
+	results := make(chan FlushResult, 1)
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.OnFlush = func(result FlushResult) {
+		results <- result
+	}
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Mr. Peanutbutter"}
+	collector.Collect("s0", event, event)
+	collector.Collect("s1", event)
+	collector.Collect("s2", event)
+	collector.Close()
+
+	assert.Equal(suite.T(), FlushResult{
+		Endpoint: server.URL,
+		Streams: map[string]StreamResult{
+			"s0": {Accepted: 1, Rejected: 1, Errors: []RejectedEvent{{Index: 1, Error: "bad value"}}},
+			"s1": {Accepted: 1},
+			"s2": {Accepted: 1},
+		},
+	}, <-results)
+
+	// Without a report from the server, every event was accepted
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer empty.Close()
+	config.Endpoint = empty.URL
+
+	collector = NewCollector("deadbeef", config)
+	collector.Collect("s0", event, event)
+	collector.Close()
+	assert.Equal(suite.T(), map[string]StreamResult{"s0": {Accepted: 2}}, (<-results).Streams)
+}
+
+func (suite *CollectorTestSuite) TestSynchronous() {
+	status := http.StatusOK
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.Endpoint = server.URL
+	config.Synchronous = true
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Vincent Adultman"}
+	assert.Nil(suite.T(), collector.Collect("s0", event))
+	assert.Equal(suite.T(), 1, requests)
+	assert.Nil(suite.T(), collector.Collect("s0", event, event))
+	assert.Equal(suite.T(), 2, requests)
+
+	status = http.StatusUnauthorized
+	assert.Equal(suite.T(), ErrInvalidAPIKey, collector.Collect("s0", event))
+
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(3), stats.Delivered)
+	assert.Equal(suite.T(), int64(1), stats.Failed)
+}
+
+func (suite *CollectorTestSuite) TestCompress() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	assert.False(suite.T(), config.DisableCompression)
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Ruthie"}
+	expected := map[string]interface{}{"s0": []interface{}{event}}
+
+	collector.Collect("s0", event)
+	request := <-rchan
+	assert.Equal(suite.T(), "gzip", request.header.Get("Content-Encoding"))
+	assert.Equal(suite.T(), expected, request.body)
+
+	config.DisableCompression = true
+	collector.Collect("s0", event)
+	request = <-rchan
+	assert.Equal(suite.T(), "", request.header.Get("Content-Encoding"))
+	assert.Equal(suite.T(), expected, request.body)
+	assert.Equal(suite.T(), "", collector.Stats().LastFlushEncoding)
+}
+
+func (suite *CollectorTestSuite) TestMaxBatchBytes() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.MaxBatchBytes = 100
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// 27 bytes each, so 3 fit alongside the stream's overhead
+	event := map[string]interface{}{"name": "Judah Mannowdog"}
+	for i := 0; i < 4; i++ {
+		collector.Collect("s0", event)
+	}
+	request := <-rchan
+	assert.Equal(suite.T(), 3, len(request.body["s0"].([]interface{})))
+
+	// Oversized events are sent on their own rather than stalling
+	large := map[string]interface{}{"name": strings.Repeat("x", 200)}
+	collector.Collect("s0", large)
+
+	// The two requests are in flight concurrently, so may arrive in any order
+	var sizes []int
+	for i := 0; i < 2; i++ {
+		request = <-rchan
+		events := request.body["s0"].([]interface{})
+		assert.Equal(suite.T(), 1, len(events))
+		sizes = append(sizes, len(events[0].(map[string]interface{})["name"].(string)))
+	}
+	sort.Ints(sizes)
+	assert.Equal(suite.T(), []int{15, 200}, sizes)
+}
+
+func (suite *CollectorTestSuite) TestFlushDebounce() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 200 * time.Millisecond
+	config.BatchSize = 2
+	config.Endpoint = server.URL
+
+	startTime := time.Now()
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// Keep flushing by BatchSize, each flush following the server receiving
+	// the last one, with an event always left buffered. The ticks along the
+	// way come right after a flush and are skipped, so that event is only
+	// ever flushed with the next one.
+	event := map[string]interface{}{"name": "Pickles Aplenty"}
+	collector.Collect("s0", event)
+	var last time.Time
+	for last.Sub(startTime) < 2*config.FlushInterval {
+		collector.Collect("s0", event)
+		collector.Collect("s0", event)
+
+		request := <-rchan
+		assert.Equal(suite.T(), 2, len(request.body["s0"].([]interface{})))
+		last = request.time
+	}
+
+	// Once flushes stop, the next tick flushes the remaining event
+	request := <-rchan
+	assert.Equal(suite.T(), 1, len(request.body["s0"].([]interface{})))
+	assert.True(suite.T(), request.time.Sub(last) >= config.FlushInterval/flushDebounce)
+}
+
+func (suite *CollectorTestSuite) TestCloseContext() {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body so that the server notices the client going away
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = hung.URL
+	config.Timeout = time.Minute
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Beatrice Horseman"}
+	collector.Collect("s0", event, event)
+	collector.Collect("s1", event)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := collector.CloseContext(ctx)
+	assert.True(suite.T(), errors.Is(err, context.DeadlineExceeded))
+	cerr, ok := err.(*CloseError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), int64(3), cerr.Pending)
+	assert.Equal(suite.T(), 1, cerr.InFlight)
+
+	// The hung flush was aborted
+	start := time.Now()
+	collector.Close()
+	assert.True(suite.T(), time.Since(start) < time.Second)
+	assert.Equal(suite.T(), int64(3), collector.Stats().Failed)
+
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+	config.Endpoint = server.URL
+
+	collector = NewCollector("deadbeef", config)
+	collector.Collect("s0", event)
+	assert.Nil(suite.T(), collector.CloseContext(context.Background()))
+	<-rchan
+}
+
+func (suite *CollectorTestSuite) TestCloseConcurrentCollect() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.BatchSize = 10
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Diane Nguyen"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for collector.Collect("s0", event) == nil {
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		collector.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("Close blocked")
+	}
+	wg.Wait()
+
+	// Every collected event was either sent or dropped
+	stats := collector.Stats()
+	assert.True(suite.T(), stats.Dropped >= 50)
+	assert.Equal(suite.T(), int64(0), stats.Failed)
+	assert.Equal(suite.T(), stats.Collected, stats.Delivered+stats.Dropped)
+}
+
+func (suite *CollectorTestSuite) TestDrainTimeout() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Logger = logger
+	config.FlushInterval = time.Hour
+	config.BatchSize = 1
+	config.MaxConcurrentRequests = 1
+	config.DrainTimeout = 50 * time.Millisecond
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	config.SpillPath = filepath.Join(dir, "spill.ndjson")
+
+	// Sending the backlog one event at a time would take 5s
+	collector := NewCollector("deadbeef", config)
+	for i := 0; i < 50; i++ {
+		collector.Collect("s0", map[string]interface{}{"i": i})
+	}
+
+	start := time.Now()
+	collector.Close()
+	assert.True(suite.T(), time.Since(start) < 2*time.Second)
+	assert.NotNil(suite.T(), logger.find("Timed out draining collected events"))
+
+	// The events that weren't drained are accounted for and spilled once Close
+	// returns
+	stats := collector.Stats()
+	assert.True(suite.T(), stats.Dropped > 0)
+	assert.Equal(suite.T(), int64(50), stats.Delivered+stats.Dropped)
+	b, err := ioutil.ReadFile(config.SpillPath)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int(stats.Dropped), strings.Count(string(b), "\n"))
+}
+
+func (suite *CollectorTestSuite) TestMaxConcurrentRequests() {
+	var inFlight, maxInFlight, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.BatchSize = 1
+	config.MaxConcurrentRequests = 2
+
+	collector := NewCollector("deadbeef", config)
+	for i := 0; i < 10; i++ {
+		collector.Collect("s0", map[string]interface{}{"i": i})
+	}
+	// Flush takes in the events one at a time, unlike Close's final drain
+	assert.Nil(suite.T(), collector.Flush())
+	collector.Close()
+
+	assert.Equal(suite.T(), int32(10), atomic.LoadInt32(&requests))
+	assert.Equal(suite.T(), int32(2), atomic.LoadInt32(&maxInFlight))
+
+	config.MaxConcurrentRequests = -1
+	assert.Panics(suite.T(), func() { NewCollector("deadbeef", config) })
+}
+
+func (suite *CollectorTestSuite) TestRuntimeStats() {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if r.Header.Get("Content-Length") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.BatchSize = 2
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+
+	event := map[string]interface{}{"name": "Emily"}
+	collector.Collect("s0", event, event)
+	collector.Collect("s0", event)
+
+	start := time.Now()
+	for collector.Stats().Buffered < 1 && time.Since(start) < 2*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(1), stats.Buffered)
+	assert.Equal(suite.T(), 1, stats.InFlight)
+	assert.Equal(suite.T(), int64(0), stats.Batches)
+
+	close(release)
+	collector.Close()
+
+	stats = collector.Stats()
+	assert.Equal(suite.T(), int64(0), stats.Buffered)
+	assert.Equal(suite.T(), 0, stats.InFlight)
+	assert.Equal(suite.T(), int64(2), stats.Batches)
+	assert.Equal(suite.T(), int64(0), stats.FailedBatches)
+	assert.Equal(suite.T(), int64(3), stats.Delivered)
+}
+
+func (suite *CollectorTestSuite) TestMaxLifetime() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.MaxLifetime = 200 * time.Millisecond
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Todd Chavez"}
+	collector.Collect("s0", event, event)
+
+	select {
+	case request := <-rchan:
+		assert.Equal(suite.T(), map[string]interface{}{
+			"s0": []interface{}{event, event},
+		}, request.body)
+	case <-time.After(2 * time.Second):
+		suite.T().Fatal("events were not flushed after MaxLifetime")
+	}
+
+	collector.tomb.Wait()
+	assert.False(suite.T(), collector.tomb.Alive())
+
+	// Collecting after shutdown must not block
+	collector.Collect("s0", event)
+}
+
+func (suite *CollectorTestSuite) TestBytesOnWire() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	var sent int
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Observer = func(m *RequestMetrics) {
+		sent += m.BytesSent
+	}
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", map[string]interface{}{"name": "Diane Nguyen"})
+	<-rchan
+	collector.Close()
+
+	stats := collector.Stats()
+	assert.True(suite.T(), stats.BytesSent > 0)
+	assert.Equal(suite.T(), int64(sent), stats.BytesSent)
+	assert.Equal(suite.T(), "gzip", stats.LastFlushEncoding)
+	assert.Equal(suite.T(), compressionLevel, stats.LastFlushCompressionLevel)
+}
+
+func (suite *CollectorTestSuite) TestCollectWithDeadline() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Sarah Lynn"}
+	early := time.Date(2016, time.October, 3, 22, 19, 51, 0, time.UTC)
+
+	collector.Collect("s0", event)
+	request := <-rchan
+	assert.Equal(suite.T(), "", request.header.Get(DeadlineHeader))
+
+	collector.CollectWithDeadline("s0", early.Add(time.Minute), event)
+	collector.CollectWithDeadline("s0", early, event)
+	collector.Collect("s0", event)
+	request = <-rchan
+	assert.Equal(suite.T(), "2016-10-03T22:19:51Z", request.header.Get(DeadlineHeader))
+	assert.Equal(suite.T(), 3, len(request.body["s0"].([]interface{})))
+}
+
+func (suite *CollectorTestSuite) TestChecksum() {
+	sums := make(chan [2]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, _ := gzip.NewReader(r.Body)
+		defer gz.Close()
+		body, _ := ioutil.ReadAll(gz)
+		sum := sha256.Sum256(body)
+		sums <- [2]string{r.Header.Get(ChecksumHeader), hex.EncodeToString(sum[:])}
+	}))
+	defer server.Close()
+
+	var checksum string
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Observer = func(m *RequestMetrics) { checksum = m.Checksum }
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	assert.Nil(suite.T(), collector.SelfTest())
+	sum := <-sums
+	assert.Equal(suite.T(), "", sum[0])
+	assert.Equal(suite.T(), "", checksum)
+
+	config.Checksum = true
+	assert.Nil(suite.T(), collector.SelfTest())
+	sum = <-sums
+	assert.Equal(suite.T(), sum[1], sum[0])
+	assert.Equal(suite.T(), sum[1], checksum)
+}
+
+func (suite *CollectorTestSuite) TestSelfTest() {
+	server, rchan := createMockCollectServer()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	assert.Nil(suite.T(), collector.SelfTest())
+	request := <-rchan
+	events := request.body[SelfTestStream].([]interface{})
+	assert.Equal(suite.T(), 1, len(events))
+	assert.Equal(suite.T(), Version, events[0].(map[string]interface{})["version"])
+
+	server.Close()
+	assert.Equal(suite.T(), ErrRequestFailed, collector.SelfTest())
+}
+
+func (suite *CollectorTestSuite) TestLatencyHistogram() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	var metrics *RequestMetrics
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.MaxBufferAge = 100 * time.Millisecond
+	config.Endpoint = server.URL
+	config.Observer = func(m *RequestMetrics) {
+		metrics = m
+	}
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", map[string]interface{}{"name": "Hollyhock"})
+	<-rchan
+	collector.Close()
+
+	assert.True(suite.T(), metrics.OldestEventAge >= config.MaxBufferAge)
+	assert.True(suite.T(), metrics.NewestEventAge <= metrics.OldestEventAge)
+
+	stats := collector.Stats()
+	assert.Equal(suite.T(), len(stats.LatencyBuckets)+1, len(stats.Latency))
+
+	// MaxBufferAge of 100ms lands the only batch in the (100ms, 250ms] bucket
+	expected := make([]int64, len(stats.Latency))
+	expected[3] = 1
+	assert.Equal(suite.T(), expected, stats.Latency)
+}
+
+func (suite *CollectorTestSuite) TestSyncFallback() {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 50 * time.Millisecond
+	config.Endpoint = server.URL
+	config.FallbackThreshold = 1
+	config.FallbackRetries = 2
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Vincent Adultman"}
+
+	// The first flush fails asynchronously
+	collector.Collect("s0", event)
+	for atomic.LoadInt32(&requests) < 1 || !collector.isDegraded() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// So the next Collect is sent synchronously, failing once before succeeding
+	collector.Collect("s0", event)
+	assert.Equal(suite.T(), int32(3), atomic.LoadInt32(&requests))
+	assert.False(suite.T(), collector.isDegraded())
+}
+
+func (suite *CollectorTestSuite) TestWindow() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Window = 200 * time.Millisecond
+	config.WindowOffset = 50 * time.Millisecond
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	end := collector.windowEnd(time.Date(2016, time.October, 3, 22, 19, 51, 0, time.UTC))
+	assert.Equal(suite.T(), time.Date(2016, time.October, 3, 22, 19, 51, 50000000, time.UTC), end)
+
+	collector.Collect("s0", map[string]interface{}{"name": "Herb Kazzaz"})
+	request := <-rchan
+
+	// Flushed right at the end of a window
+	offset := request.time.Add(-config.WindowOffset).Sub(request.time.Add(-config.WindowOffset).Truncate(config.Window))
+	assert.True(suite.T(), offset < 50*time.Millisecond, "flushed %s into the window", offset)
+}
+
+func (suite *CollectorTestSuite) TestBlockedTime() {
+	// A server slow enough that the collector can't keep up, until it's not
+	var slow int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Logger = logger
+	config.FlushInterval = time.Hour
+	config.BatchSize = 1
+	config.MaxConcurrentRequests = 1
+	config.BlockedWarnThreshold = 10 * time.Millisecond
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+	assert.Equal(suite.T(), time.Duration(0), collector.Stats().BlockedTime)
+
+	// One event is in flight and another waits for it, so the buffer of 100
+	// is full after 102 and the next two Collect calls each wait for a flush
+	for i := 0; i < 104; i++ {
+		collector.Collect("s0", map[string]interface{}{"i": i})
+	}
+	atomic.StoreInt32(&slow, 0)
+	assert.True(suite.T(), collector.Stats().BlockedTime >= 2*config.BlockedWarnThreshold)
+
+	// Repeated warnings are rate limited
+	n, _ := logger.count("Collect blocked on a full buffer, the collector can't keep up")
+	assert.Equal(suite.T(), 1, n)
+}
+
+func (suite *CollectorTestSuite) TestCloseDuringFlush() {
+	var mu sync.Mutex
+	received := make(map[float64]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Slow enough for Close to race with in-flight flushes
+		time.Sleep(50 * time.Millisecond)
+
+		gz, _ := gzip.NewReader(r.Body)
+		defer gz.Close()
+		var v map[string][]map[string]float64
+		json.NewDecoder(gz).Decode(&v)
+
+		mu.Lock()
+		for _, event := range v["s0"] {
+			received[event["i"]]++
+		}
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.BatchSize = 7
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+
+	const producers, perProducer = 4, 250
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				collector.Collect("s0", map[string]interface{}{"i": p*perProducer + i})
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	collector.Close()
+	collector.Close()
+
+	assert.Equal(suite.T(), producers*perProducer, len(received))
+	for i, n := range received {
+		assert.Equal(suite.T(), 1, n, "event %v received %d times", i, n)
+	}
+
+	assert.Equal(suite.T(), ErrCollectorClosed, collector.Collect("s0", map[string]interface{}{"i": -1}))
+	assert.Equal(suite.T(), int64(1), collector.Stats().Dropped)
+}
+
+func (suite *CollectorTestSuite) TestMaxStreams() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.MaxStreams = 2
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+
+	event := map[string]interface{}{"name": "Character Actress Margo Martindale"}
+	collector.Collect("s0", event)
+	collector.Collect("s1", event)
+	collector.Collect("s0", event)
+	collector.Collect("s2", event)
+
+	request := <-rchan
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{event, event},
+		"s1": []interface{}{event},
+	}, request.body)
+
+	collector.Close()
+	request = <-rchan
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s2": []interface{}{event},
+	}, request.body)
+}
+
+func (suite *CollectorTestSuite) TestAutoCreateStreams() {
+	var mu sync.Mutex
+	var creates []string
+	rchan := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path != "/collect" {
+			creates = append(creates, r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if len(creates) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		gz, _ := gzip.NewReader(r.Body)
+		defer gz.Close()
+		var v map[string]interface{}
+		json.NewDecoder(gz).Decode(&v)
+		rchan <- v
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.AutoCreateStreams = true
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Ralph Stilton"}
+	collector.Collect("s0", event)
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{event},
+	}, <-rchan)
+
+	collector.Collect("s0", event)
+	<-rchan
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(suite.T(), []string{"/collect/s0"}, creates)
+}
+
+func (suite *CollectorTestSuite) TestCollectorContext() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.Endpoint = server.URL
+	config.Logger = logger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	collector := NewCollectorContext(ctx, "deadbeef", config)
+
+	event := map[string]interface{}{"name": "Judah Mannowdog"}
+	collector.Collect("s0", event)
+	cancel()
+
+	request := <-rchan
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{event},
+	}, request.body)
+
+	collector.Close()
+	assert.False(suite.T(), collector.tomb.Alive())
+	// The collector only shuts down once for the context
+	n, _ := logger.count("Collector context done")
+	assert.Equal(suite.T(), 1, n)
+
+	// Flushes don't outlive the context's deadline
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	collector = NewCollectorContext(ctx, "deadbeef", config)
+	defer collector.Close()
+
+	deadline, ok := collector.flushCtx.Deadline()
+	assert.True(suite.T(), ok)
+	expected, _ := ctx.Deadline()
+	assert.Equal(suite.T(), expected, deadline)
+}
+
+func (suite *CollectorTestSuite) TestStreamCompression() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = server.URL
+	config.StreamCompression = true
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	event := map[string]interface{}{"name": "Hollyhock"}
+	collector.Collect("s0", event, event)
+	assert.Nil(suite.T(), collector.Flush())
+	req := <-rchan
+	assert.Equal(suite.T(), "gzip", req.header.Get("Content-Encoding"))
+	assert.Equal(suite.T(), map[string]interface{}{"s0": []interface{}{event, event}}, req.body)
+	assert.True(suite.T(), collector.Stats().BytesSent > 0)
+
+	// Events that fail to encode fail the flush as before
+	collector.Collect("s0", map[string]interface{}{"f": func() {}})
+	assert.Equal(suite.T(), ErrInvalidBody, collector.Flush())
+}
+
+func (suite *CollectorTestSuite) TestDedupeByID() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.Endpoint = server.URL
+	config.DedupeByID = true
+
+	collector := NewCollector("deadbeef", config)
+	for i := 0; i < 5; i++ {
+		collector.Collect("s0", NewEvent().ID("a").Set("try", i), NewEvent().Set("try", i))
+		collector.Collect("s0", NewEvent().ID("b").Set("try", i))
+		collector.Collect("s1", NewEvent().ID("a").Set("try", i))
+	}
+	collector.Close()
+
+	req := <-rchan
+	assert.Equal(suite.T(), []interface{}{
+		map[string]interface{}{ID: "a", "try": float64(4)},
+		map[string]interface{}{"try": float64(0)},
+		map[string]interface{}{ID: "b", "try": float64(4)},
+		map[string]interface{}{"try": float64(1)},
+		map[string]interface{}{"try": float64(2)},
+		map[string]interface{}{"try": float64(3)},
+		map[string]interface{}{"try": float64(4)},
+	}, req.body["s0"])
+	assert.Equal(suite.T(), []interface{}{
+		map[string]interface{}{ID: "a", "try": float64(4)},
+	}, req.body["s1"])
+
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(20), stats.Collected)
+	assert.Equal(suite.T(), int64(12), stats.Deduplicated)
+	assert.Equal(suite.T(), int64(8), stats.Delivered)
+}
+
+func (suite *CollectorTestSuite) TestDedupeByIDBuffered() {
+	request := func(events ...map[string]interface{}) collectRequest {
+		return collectRequest{stream: "s0", events: events, bytes: eventBytes(StdCodec{}, events)}
+	}
+	now := time.Now()
+
+	b := newBatch()
+	assert.Equal(suite.T(), 0, b.addDeduped(request(NewEvent().ID("a"), NewEvent()), now, StdCodec{}))
+	assert.Equal(suite.T(), 2, b.addDeduped(request(NewEvent().ID("a").Set("try", 1), NewEvent().ID("a").Set("try", 2)), now, StdCodec{}))
+
+	// Replaced events no longer count towards the batch's size
+	expected := newBatch()
+	expected.add(request(NewEvent().ID("a").Set("try", 2), NewEvent()), now)
+	assert.Equal(suite.T(), expected.events, b.events)
+	assert.Equal(suite.T(), expected.size, b.size)
+	assert.Equal(suite.T(), expected.bytes, b.bytes)
+}
+
+func (suite *CollectorTestSuite) TestIdempotency() {
+	primary, pchan := createMockCollectServer()
+	defer primary.Close()
+	mirror, mchan := createMockCollectServer()
+	defer mirror.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 10 * time.Second
+	config.BatchSize = 1
+	config.Endpoint = primary.URL
+	config.MirrorEndpoints = []string{mirror.URL}
+	config.Idempotency = true
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Hollyhock"}
+
+	// A batch has the same key for each endpoint, but batches have different keys
+	collector.Collect("s0", event)
+	key := (<-pchan).header.Get(IdempotencyKeyHeader)
+	assert.Equal(suite.T(), 36, len(key))
+	assert.Equal(suite.T(), key, (<-mchan).header.Get(IdempotencyKeyHeader))
+
+	collector.Collect("s0", event)
+	next := (<-pchan).header.Get(IdempotencyKeyHeader)
+	<-mchan
+	assert.Equal(suite.T(), 36, len(next))
+	assert.NotEqual(suite.T(), key, next)
+	collector.Close()
+
+	config.MirrorEndpoints = nil
+	config.Idempotency = false
+	collector = NewCollector("deadbeef", config)
+	collector.Collect("s0", event)
+	assert.Equal(suite.T(), "", (<-pchan).header.Get(IdempotencyKeyHeader))
+	collector.Close()
+}
+
+func (suite *CollectorTestSuite) TestEndpointTrailingSlash() {
+	paths := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL + "/api/v1/"
+
+	collector := NewCollector("deadbeef", config)
+	assert.Nil(suite.T(), collector.Verify(context.Background()))
+	collector.Collect("s0", map[string]interface{}{"name": "Ruthie"})
+	collector.Close()
+
+	assert.Equal(suite.T(), "/api/v1/collect", <-paths)
+	assert.Equal(suite.T(), "/api/v1/collect", <-paths)
+}
+
+func (suite *CollectorTestSuite) TestClient() {
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	config := NewCollectorConfig()
+	config.Client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		r, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		var body map[string][]map[string]interface{}
+		if err := json.NewDecoder(r).Decode(&body); err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		events = append(events, body["s0"]...)
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", map[string]interface{}{"name": "Todd Chavez"})
+	collector.Close()
+
+	assert.Equal(suite.T(), []map[string]interface{}{{"name": "Todd Chavez"}}, events)
+	assert.Equal(suite.T(), int64(1), collector.Stats().Delivered)
+}
+
+func (suite *CollectorTestSuite) TestAdaptiveInterval() {
+	config := NewCollectorConfig()
+	config.FlushInterval = 100 * time.Millisecond
+	config.BatchSize = 100
+	a := newAdaptiveInterval(config)
+	assert.Equal(suite.T(), 10*time.Millisecond, a.min)
+	assert.Equal(suite.T(), time.Second, a.max)
+
+	// Full batches shrink the interval down to the minimum
+	assert.Equal(suite.T(), 50*time.Millisecond, a.next(100))
+	assert.Equal(suite.T(), 25*time.Millisecond, a.next(250))
+	assert.Equal(suite.T(), 12500*time.Microsecond, a.next(100))
+	assert.Equal(suite.T(), 10*time.Millisecond, a.next(100))
+
+	// Moderately full ones keep it, once the average has come down
+	assert.Equal(suite.T(), 10*time.Millisecond, a.next(30))
+	assert.Equal(suite.T(), 10*time.Millisecond, a.next(30))
+
+	// Idle intervals grow it up to the maximum
+	config.MinFlushInterval = 50 * time.Millisecond
+	config.MaxFlushInterval = 300 * time.Millisecond
+	a = newAdaptiveInterval(config)
+	assert.Equal(suite.T(), 200*time.Millisecond, a.next(0))
+	assert.Equal(suite.T(), 300*time.Millisecond, a.next(5))
+	assert.Equal(suite.T(), 300*time.Millisecond, a.next(0))
+	assert.Equal(suite.T(), 150*time.Millisecond, a.next(1000))
+}
+
+func (suite *CollectorTestSuite) TestAdaptiveFlush() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Logger = logger
+	config.FlushInterval = 10 * time.Millisecond
+	config.MaxFlushInterval = 40 * time.Millisecond
+	config.AdaptiveFlush = true
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// Events are flushed on the ticks of the adapted interval. The tick that
+	// flushed the first event adapted the interval before the second is flushed.
+	for _, name := range []string{"Diane Nguyen", "Todd Chavez"} {
+		collector.Collect("s0", map[string]interface{}{"name": name})
+		assert.Equal(suite.T(), map[string]interface{}{
+			"s0": []interface{}{map[string]interface{}{"name": name}},
+		}, (<-rchan).body)
+	}
+
+	// A mostly idle collector backs off towards MaxFlushInterval
+	line := logger.find("Adapted flush interval")
+	assert.NotNil(suite.T(), line)
+	assert.Equal(suite.T(), 10*time.Millisecond, line.fields["from"])
+	assert.Equal(suite.T(), 20*time.Millisecond, line.fields["to"])
+	logger.mu.Lock()
+	for _, l := range logger.lines {
+		if l.msg == "Adapted flush interval" {
+			assert.True(suite.T(), l.fields["to"].(time.Duration) <= 40*time.Millisecond)
+		}
+	}
+	logger.mu.Unlock()
+}
+
+func (suite *CollectorTestSuite) TestDryRun() {
+	logger := &mockLogger{}
+	config := NewCollectorConfig()
+	config.Logger = logger
+	config.DryRun = true
+	// The payload is logged whether or not the batch is also hashed
+	config.Checksum = true
+	var sent int32
+	config.Client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&sent, 1)
+		return nil, errors.New("request sent in a dry run")
+	})
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Mr. Peanutbutter"}
+	collector.Collect("s0", event, event)
+	collector.Collect("s1", event)
+	collector.Close()
+	assert.Equal(suite.T(), int32(0), atomic.LoadInt32(&sent))
+
+	line := logger.find("Dry run, not sending events")
+	assert.NotNil(suite.T(), line)
+	assert.Equal(suite.T(), "debug", line.level)
+	assert.Equal(suite.T(), 3, line.fields["num_events"])
+	assert.Equal(suite.T(), map[string]int{"s0": 2, "s1": 1}, line.fields["streams"])
+	assert.Contains(suite.T(), line.fields["payload"], `"s1":[{"name":"Mr. Peanutbutter"}]`)
+	assert.Equal(suite.T(), int64(3), collector.Stats().Delivered)
+}
+
+func (suite *CollectorTestSuite) TestRateLimit() {
+	var mu sync.Mutex
+	var requests []time.Time
+	reset := time.Now().Add(time.Second).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, time.Now())
+		mu.Unlock()
+		w.Header().Set(RateLimitLimitHeader, "1")
+		w.Header().Set(RateLimitRemainingHeader, "0")
+		w.Header().Set(RateLimitResetHeader, fmt.Sprintf("%d", reset.Unix()))
+	}))
+	defer server.Close()
+
+	var observed []*RateLimit
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Observer = func(m *RequestMetrics) {
+		observed = append(observed, m.RateLimit)
+	}
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Bojack Horseman"}
+	collector.Collect("s0", event)
+	assert.Nil(suite.T(), collector.Flush())
+
+	// The next flush waits for the rate limit to reset
+	collector.Collect("s0", event)
+	assert.Nil(suite.T(), collector.Flush())
+	collector.Close()
+
+	assert.Equal(suite.T(), 2, len(requests))
+	assert.False(suite.T(), requests[1].Before(reset))
+	assert.Equal(suite.T(), 2, len(observed))
+	assert.Equal(suite.T(), &RateLimit{Limit: 1, Remaining: 0, Reset: reset}, observed[0])
+}
+
+func (suite *CollectorTestSuite) TestRateLimitFarReset() {
+	reset := time.Now().Add(2 * maxRateLimitReset)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set(RateLimitLimitHeader, "1")
+		w.Header().Set(RateLimitRemainingHeader, "0")
+		w.Header().Set(RateLimitResetHeader, fmt.Sprintf("%d", reset.Unix()))
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// A reset this far off is ignored rather than pausing flushes until then
+	event := map[string]interface{}{"name": "Princess Carolyn"}
+	collector.Collect("s0", event)
+	assert.Nil(suite.T(), collector.Flush())
+
+	start := time.Now()
+	collector.Collect("s0", event)
+	assert.Nil(suite.T(), collector.Flush())
+	assert.True(suite.T(), time.Since(start) < time.Second)
+}
+
+func (suite *CollectorTestSuite) TestTracer() {
+	spans := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		spans <- r.Header.Get("Span")
+	}))
+	defer server.Close()
+
+	tracer := &mockTracer{}
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Tracer = tracer
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", map[string]interface{}{"name": "Todd Chavez"})
+	collector.Close()
+
+	assert.Equal(suite.T(), "POST /collect", <-spans)
+	assert.Equal(suite.T(), []span{{"POST /collect", http.StatusOK, nil}}, tracer.finished())
+}
+
+func (suite *CollectorTestSuite) TestUserAgent() {
+	agents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		agents <- r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.UserAgent = "bojack/1.0"
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", map[string]interface{}{"name": "Todd Chavez"})
+	collector.Close()
+	assert.Equal(suite.T(), "gostride (version: "+Version+") bojack/1.0", <-agents)
+}
+
+func (suite *CollectorTestSuite) TestTransport() {
+	protos := make(chan int, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cert, _ := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.RootCAs = x509.NewCertPool()
+	config.RootCAs.AddCert(cert)
+
+	// The default transport negotiates HTTP/2
+	collector := NewCollector("deadbeef", config)
+	transport := collector.client.(*http.Client).Transport.(*http.Transport)
+	assert.Equal(suite.T(), maxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	collector.Collect("s0", map[string]interface{}{"name": "Character Actress Margo Martindale"})
+	collector.Close()
+	assert.Equal(suite.T(), 2, <-protos)
+
+	// A configured transport is shared as is
+	config.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: config.RootCAs}}
+	collector = NewCollector("deadbeef", config)
+	assert.True(suite.T(), collector.client.(*http.Client).Transport == config.Transport)
+	collector.Collect("s0", map[string]interface{}{"name": "Character Actress Margo Martindale"})
+	collector.Close()
+	assert.Equal(suite.T(), 1, <-protos)
+}
+
+func (suite *CollectorTestSuite) TestMirrorEndpoints() {
+	primary, pchan := createMockCollectServer()
+	defer primary.Close()
+	mirror, mchan := createMockCollectServer()
+	defer mirror.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	event := map[string]interface{}{"name": "Pickles Aplenty"}
+
+	// Best-effort, so the broken mirror doesn't fail the flush
+	config := NewCollectorConfig()
+	config.Endpoint = primary.URL
+	config.MirrorEndpoints = []string{mirror.URL, broken.URL}
+	config.DeadLetterCapacity = 10
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", event)
+	expected := map[string]interface{}{"s0": []interface{}{event}}
+	assert.Equal(suite.T(), expected, (<-pchan).body)
+	assert.Equal(suite.T(), expected, (<-mchan).body)
+	collector.Close()
+	assert.Equal(suite.T(), 0, len(collector.DeadLetters()))
+
+	// All must succeed
+	config.MirrorEndpoints = []string{broken.URL}
+	config.RequireAllEndpoints = true
+
+	collector = NewCollector("deadbeef", config)
+	collector.Collect("s0", event)
+	<-pchan
+	collector.Close()
+
+	failed := collector.DeadLetters()
+	assert.Equal(suite.T(), 1, len(failed))
+	err, ok := failed[0].Error.(*FanOutError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), map[string]error{broken.URL: ErrServerError}, err.Errors)
+	assert.Equal(suite.T(), []string{broken.URL}, failed[0].Endpoints)
+}
+
+func (suite *CollectorTestSuite) TestMirrorEndpointsRetry() {
+	primary, pchan := createMockCollectServer()
+	defer primary.Close()
+	var attempts int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = primary.URL
+	config.MirrorEndpoints = []string{flaky.URL}
+	config.RequireAllEndpoints = true
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	b := newBatch()
+	b.add(collectRequest{stream: "s0", events: []map[string]interface{}{{}}}, time.Now())
+	assert.NotNil(suite.T(), collector.flush(b))
+	<-pchan
+
+	// The retry only goes to the mirror that failed
+	assert.Nil(suite.T(), collector.flush(b))
+	assert.Equal(suite.T(), int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(suite.T(), 0, len(pchan))
+}
+
+func (suite *CollectorTestSuite) TestValidateContentType() {
+	assert.True(suite.T(), isJSONContentType(""))
+	assert.True(suite.T(), isJSONContentType("application/json"))
+	assert.True(suite.T(), isJSONContentType("application/json; charset=UTF-8"))
+	assert.True(suite.T(), isJSONContentType("application/problem+json"))
+	assert.False(suite.T(), isJSONContentType("text/html; charset=utf-8"))
+	assert.False(suite.T(), isJSONContentType("not a content type;;"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>Welcome to nginx!</html>"))
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+	assert.Nil(suite.T(), collector.SelfTest())
+
+	config.ValidateContentType = true
+	assert.Equal(suite.T(), ErrInvalidResponse, collector.SelfTest())
+}
+
+func (suite *CollectorTestSuite) TestVerify() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(suite.T(), http.MethodGet, r.Method)
+		assert.Equal(suite.T(), "/collect", r.URL.Path)
+		if user, _, _ := r.BasicAuth(); user != "deadbeef" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`["s0"]`))
+	}))
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+	assert.Equal(suite.T(), server.URL, collector.Endpoint())
+	assert.Nil(suite.T(), collector.Verify(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(suite.T(), context.Canceled, collector.Verify(ctx))
+
+	unauthorized := NewCollector("badkey", config)
+	defer unauthorized.Close()
+	err := unauthorized.Verify(context.Background())
+	assert.Equal(suite.T(), ErrInvalidAPIKey, err.(*VerifyError).Err)
+	assert.Contains(suite.T(), err.Error(), "rejected the API key")
+
+	server.Close()
+	err = collector.Verify(context.Background())
+	assert.Equal(suite.T(), ErrRequestFailed, err.(*VerifyError).Err)
+	assert.NotNil(suite.T(), err.(*VerifyError).Cause)
+	assert.Contains(suite.T(), err.Error(), "is unreachable")
+}
+
 func TestCollectorTestSuite(t *testing.T) {
 	suite.Run(t, new(CollectorTestSuite))
 }
@@ -0,0 +1,66 @@
+package stride
+
+import (
+	"sync"
+	"time"
+)
+
+// FailedEvent is an event that the collector failed to send. If the flush
+// only failed for some of the mirror endpoints, Endpoints lists those that
+// didn't accept it, otherwise it's nil.
+type FailedEvent struct {
+	Stream    string
+	Event     map[string]interface{}
+	Error     error
+	Time      time.Time
+	Endpoints []string
+}
+
+// deadLetters is a bounded queue retaining the most recent failed events
+type deadLetters struct {
+	mu     sync.Mutex
+	events []FailedEvent
+	next   int
+	full   bool
+}
+
+func newDeadLetters(capacity int) *deadLetters {
+	return &deadLetters{events: make([]FailedEvent, capacity)}
+}
+
+func (d *deadLetters) add(b *batch, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	endpoints := failedEndpoints(err)
+	for stream, events := range b.events {
+		for _, event := range events {
+			d.events[d.next] = FailedEvent{stream, event, err, now, endpoints}
+			d.next = (d.next + 1) % len(d.events)
+			if d.next == 0 {
+				d.full = true
+			}
+		}
+	}
+}
+
+func (d *deadLetters) list() []FailedEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.full {
+		return append([]FailedEvent(nil), d.events[:d.next]...)
+	}
+	return append(append([]FailedEvent(nil), d.events[d.next:]...), d.events[:d.next]...)
+}
+
+// DeadLetters returns the most recent events that failed to send, oldest
+// first, if CollectorConfig.DeadLetterCapacity is set. This is a best-effort
+// debugging aid, so older failures are discarded once the capacity is reached.
+func (c *Collector) DeadLetters() []FailedEvent {
+	if c.deadLetters == nil {
+		return nil
+	}
+	return c.deadLetters.list()
+}
@@ -0,0 +1,51 @@
+package stride
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeadLetterTestSuite struct {
+	suite.Suite
+}
+
+func (suite *DeadLetterTestSuite) TestDeadLetters() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.DeadLetterCapacity = 3
+
+	collector := NewCollector("deadbeef", config)
+	assert.Nil(suite.T(), collector.DeadLetters())
+
+	for i := 0; i < 5; i++ {
+		collector.Collect("s0", map[string]interface{}{"i": i})
+	}
+	collector.Close()
+
+	failed := collector.DeadLetters()
+	assert.Equal(suite.T(), 3, len(failed))
+	for i, f := range failed {
+		assert.Equal(suite.T(), "s0", f.Stream)
+		assert.Equal(suite.T(), i+2, f.Event["i"])
+		assert.Equal(suite.T(), ErrInvalidBody, f.Error)
+	}
+
+	d := newDeadLetters(3)
+	b := newBatch()
+	b.add(collectRequest{stream: "s0", events: []map[string]interface{}{{"i": 0}}}, b.newest)
+	d.add(b, ErrServerError)
+	assert.Equal(suite.T(), 1, len(d.list()))
+}
+
+func TestDeadLetterTestSuite(t *testing.T) {
+	suite.Run(t, new(DeadLetterTestSuite))
+}
@@ -0,0 +1,121 @@
+package stride
+
+import (
+	"sync"
+	"time"
+)
+
+// errorLimiter rate limits repeated error logs, so that sustained failures such
+// as an outage don't flood the logs. The first occurrence of each message is
+// logged, and afterwards at most one per interval, along with the number of
+// occurrences suppressed in between. If a message stops recurring, the count of
+// its last suppressed occurrences is logged once their interval is over.
+type errorLimiter struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]*suppressedLog
+}
+
+// suppressedLog is a message suppressed since it was last logged, which is
+// reported through the entry and level of its latest occurrence
+type suppressedLog struct {
+	count int
+	lg    *entry
+	log   func(lg *entry, msg string)
+	timer *time.Timer
+}
+
+func newErrorLimiter(interval time.Duration) *errorLimiter {
+	return &errorLimiter{
+		interval:   interval,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]*suppressedLog),
+	}
+}
+
+// error logs msg at error level through lg, subject to rate limiting
+func (l *errorLimiter) error(lg *entry, msg string) {
+	l.limit(lg, msg, (*entry).Error)
+}
+
+// warn logs msg at warn level through lg, subject to rate limiting
+func (l *errorLimiter) warn(lg *entry, msg string) {
+	l.limit(lg, msg, (*entry).Warn)
+}
+
+// limit logs msg with log now, or else suppresses it until its interval is over
+func (l *errorLimiter) limit(lg *entry, msg string, log func(lg *entry, msg string)) {
+	if l == nil || l.interval <= 0 {
+		log(lg, msg)
+		return
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	if last, ok := l.last[msg]; ok && now.Sub(last) < l.interval {
+		s := l.suppressed[msg]
+		if s == nil {
+			s = &suppressedLog{}
+			s.timer = time.AfterFunc(last.Add(l.interval).Sub(now), func() {
+				l.report(msg)
+			})
+			l.suppressed[msg] = s
+		}
+		s.count++
+		s.lg, s.log = lg, log
+		l.mu.Unlock()
+		return
+	}
+
+	// The count of suppressed occurrences goes with this log instead
+	var suppressed int
+	if s := l.suppressed[msg]; s != nil {
+		s.timer.Stop()
+		suppressed = s.count
+		delete(l.suppressed, msg)
+	}
+	l.last[msg] = now
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		lg = lg.WithField("suppressed", suppressed)
+	}
+	log(lg, msg)
+}
+
+// report logs the suppressed occurrences of msg, if any are left
+func (l *errorLimiter) report(msg string) {
+	l.mu.Lock()
+	s := l.suppressed[msg]
+	if s == nil {
+		l.mu.Unlock()
+		return
+	}
+	delete(l.suppressed, msg)
+	l.last[msg] = time.Now()
+	l.mu.Unlock()
+
+	s.log(s.lg.WithField("suppressed", s.count), msg)
+}
+
+// flush reports every message that's still suppressed right away, e.g. before
+// the component logging through l shuts down
+func (l *errorLimiter) flush() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	var msgs []string
+	for msg, s := range l.suppressed {
+		s.timer.Stop()
+		msgs = append(msgs, msg)
+	}
+	l.mu.Unlock()
+
+	for _, msg := range msgs {
+		l.report(msg)
+	}
+}
@@ -0,0 +1,75 @@
+package stride
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorLogTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ErrorLogTestSuite) TestErrorLimiter() {
+	logger := &mockLogger{}
+	lg := newEntry(logger, nil)
+	l := newErrorLimiter(200 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		l.error(lg, "boom")
+	}
+	n, _ := logger.count("boom")
+	assert.Equal(suite.T(), 1, n)
+
+	// Other messages are limited separately
+	l.warn(lg, "bang")
+	n, _ = logger.count("bang")
+	assert.Equal(suite.T(), 1, n)
+
+	// The suppressed occurrences are reported once the interval is over, even
+	// though boom doesn't recur
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if n, _ = logger.count("boom"); n == 2 {
+			break
+		}
+	}
+	n, suppressed := logger.count("boom")
+	assert.Equal(suite.T(), 2, n)
+	assert.Equal(suite.T(), 3, suppressed)
+	line := logger.find("boom")
+	assert.Equal(suite.T(), "error", line.level)
+
+	// Disabled
+	logger = &mockLogger{}
+	lg = newEntry(logger, nil)
+	l = newErrorLimiter(0)
+	for i := 0; i < 3; i++ {
+		l.error(lg, "boom")
+	}
+	n, _ = logger.count("boom")
+	assert.Equal(suite.T(), 3, n)
+}
+
+func (suite *ErrorLogTestSuite) TestErrorLimiterFlush() {
+	logger := &mockLogger{}
+	lg := newEntry(logger, nil)
+	l := newErrorLimiter(time.Hour)
+
+	l.warn(lg, "boom")
+	l.warn(lg, "boom")
+	l.flush()
+	n, suppressed := logger.count("boom")
+	assert.Equal(suite.T(), 2, n)
+	assert.Equal(suite.T(), 1, suppressed)
+
+	// Nothing left to report
+	l.flush()
+	n, _ = logger.count("boom")
+	assert.Equal(suite.T(), 2, n)
+}
+
+func TestErrorLogTestSuite(t *testing.T) {
+	suite.Run(t, new(ErrorLogTestSuite))
+}
@@ -0,0 +1,54 @@
+package stride
+
+import "time"
+
+const (
+	// Timestamp is the key to be used for the event timestamp
+	Timestamp = "$timestamp"
+	// ID is the key to be used for the event ID
+	ID = "$id"
+)
+
+// SetTimestamp sets the timestamp of an event
+func SetTimestamp(event map[string]interface{}, ts time.Time) {
+	event[Timestamp] = ts.Format(time.RFC3339Nano)
+}
+
+// SetID sets the ID of an event
+func SetID(event map[string]interface{}, id string) {
+	event[ID] = id
+}
+
+// Event is an event map with chainable setters. Since it's a map, an Event can
+// be passed wherever events are collected, e.g.
+//
+//	collector.Collect("stream", NewEvent().Set("key", "value").ID("id"))
+type Event map[string]interface{}
+
+// NewEvent returns an empty event
+func NewEvent() Event {
+	return make(Event)
+}
+
+// Set sets a property of the event
+func (e Event) Set(key string, value interface{}) Event {
+	e[key] = value
+	return e
+}
+
+// Timestamp sets the timestamp of the event
+func (e Event) Timestamp(ts time.Time) Event {
+	SetTimestamp(e, ts)
+	return e
+}
+
+// ID sets the ID of the event
+func (e Event) ID(id string) Event {
+	SetID(e, id)
+	return e
+}
+
+// Map returns the event as a plain map
+func (e Event) Map() map[string]interface{} {
+	return e
+}
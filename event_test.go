@@ -0,0 +1,48 @@
+package stride
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type EventTestSuite struct {
+	suite.Suite
+}
+
+func (suite *EventTestSuite) TestEvent() {
+	ts := time.Date(2016, time.September, 12, 9, 0, 0, 0, time.UTC)
+	event := NewEvent().Set("name", "Princess Carolyn").Set("age", 40).ID("carolyn").Timestamp(ts)
+
+	assert.Equal(suite.T(), map[string]interface{}{
+		"name":    "Princess Carolyn",
+		"age":     40,
+		ID:        "carolyn",
+		Timestamp: "2016-09-12T09:00:00Z",
+	}, event.Map())
+	assert.Nil(suite.T(), ValidateEvent(event))
+}
+
+func (suite *EventTestSuite) TestCollectEvent() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", NewEvent().Set("name", "Sarah Lynn"), map[string]interface{}{"name": "Herb"})
+	collector.Close()
+
+	req := <-rchan
+	assert.Equal(suite.T(), []interface{}{
+		map[string]interface{}{"name": "Sarah Lynn"},
+		map[string]interface{}{"name": "Herb"},
+	}, req.body["s0"])
+}
+
+func TestEventTestSuite(t *testing.T) {
+	suite.Run(t, new(EventTestSuite))
+}
@@ -0,0 +1,96 @@
+package stride
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// Fields are the structured context attached to a log message
+type Fields map[string]interface{}
+
+// Logger is the interface the client logs through. Implement it to route the
+// client's logs to an existing structured logger.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+// NewLogrusLogger returns a Logger that logs through l
+func NewLogrusLogger(l *logrus.Logger) Logger {
+	return logrusLogger{l}
+}
+
+type logrusLogger struct {
+	l *logrus.Logger
+}
+
+func (lg logrusLogger) Debug(msg string, fields Fields) {
+	lg.l.WithFields(logrus.Fields(fields)).Debug(msg)
+}
+
+func (lg logrusLogger) Info(msg string, fields Fields) {
+	lg.l.WithFields(logrus.Fields(fields)).Info(msg)
+}
+
+func (lg logrusLogger) Warn(msg string, fields Fields) {
+	lg.l.WithFields(logrus.Fields(fields)).Warn(msg)
+}
+
+func (lg logrusLogger) Error(msg string, fields Fields) {
+	lg.l.WithFields(logrus.Fields(fields)).Error(msg)
+}
+
+// defaultLogger is the Logger of default configs
+var defaultLogger = NewLogrusLogger(logrus.New())
+
+// entry accumulates fields for a log message to a Logger
+type entry struct {
+	logger Logger
+	fields Fields
+}
+
+func newEntry(logger Logger, fields Fields) *entry {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	return &entry{logger: logger, fields: fields}
+}
+
+// WithFields returns a copy of the entry with fields added
+func (e *entry) WithFields(fields Fields) *entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &entry{logger: e.logger, fields: merged}
+}
+
+// WithField returns a copy of the entry with a field added
+func (e *entry) WithField(key string, value interface{}) *entry {
+	return e.WithFields(Fields{key: value})
+}
+
+// WithError returns a copy of the entry with err added as the error field
+func (e *entry) WithError(err error) *entry {
+	return e.WithField(logrus.ErrorKey, err)
+}
+
+func (e *entry) Debug(msg string) {
+	e.logger.Debug(msg, e.fields)
+}
+
+func (e *entry) Info(msg string) {
+	e.logger.Info(msg, e.fields)
+}
+
+func (e *entry) Warn(msg string) {
+	e.logger.Warn(msg, e.fields)
+}
+
+func (e *entry) Error(msg string) {
+	e.logger.Error(msg, e.fields)
+}
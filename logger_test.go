@@ -0,0 +1,176 @@
+package stride
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LoggerTestSuite struct {
+	suite.Suite
+}
+
+type logLine struct {
+	level  string
+	msg    string
+	fields Fields
+}
+
+// mockLogger captures everything logged to it
+type mockLogger struct {
+	mu    sync.Mutex
+	lines []logLine
+}
+
+func (l *mockLogger) log(level, msg string, fields Fields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, logLine{level, msg, fields})
+}
+
+func (l *mockLogger) Debug(msg string, fields Fields) { l.log("debug", msg, fields) }
+func (l *mockLogger) Info(msg string, fields Fields)  { l.log("info", msg, fields) }
+func (l *mockLogger) Warn(msg string, fields Fields)  { l.log("warn", msg, fields) }
+func (l *mockLogger) Error(msg string, fields Fields) { l.log("error", msg, fields) }
+
+func (l *mockLogger) find(msg string) *logLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.lines {
+		if l.lines[i].msg == msg {
+			return &l.lines[i]
+		}
+	}
+	return nil
+}
+
+// count returns the number of lines logged with msg, and the suppressed field
+// of the last one
+func (l *mockLogger) count(msg string) (int, interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	var suppressed interface{}
+	for _, line := range l.lines {
+		if line.msg == msg {
+			n++
+			suppressed = line.fields["suppressed"]
+		}
+	}
+	return n, suppressed
+}
+
+func (suite *LoggerTestSuite) TestEntry() {
+	logger := &mockLogger{}
+	lg := newEntry(logger, Fields{"module": "stride"})
+	lg.WithField("status_code", 500).Error("Failed")
+	lg.Debug("Done")
+
+	assert.Equal(suite.T(), []logLine{
+		{"error", "Failed", Fields{"module": "stride", "status_code": 500}},
+		{"debug", "Done", Fields{"module": "stride"}},
+	}, logger.lines)
+}
+
+func (suite *LoggerTestSuite) TestConfigLogger() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Logger = logger
+
+	NewStride("key", config).Get("/collect")
+	line := logger.find("Stride API returned invalid status code")
+	assert.NotNil(suite.T(), line)
+	assert.Equal(suite.T(), "error", line.level)
+	assert.Equal(suite.T(), 500, line.fields["status_code"])
+
+	collectorLogger := &mockLogger{}
+	collectorConfig := NewCollectorConfig()
+	collectorConfig.Endpoint = server.URL
+	collectorConfig.Logger = collectorLogger
+	collectorConfig.Debug = true
+
+	collector := NewCollector("key", collectorConfig)
+	collector.SelfTest()
+	collector.Close()
+	assert.NotNil(suite.T(), collectorLogger.find("Stride API returned invalid status code"))
+	assert.NotNil(suite.T(), collectorLogger.find("Shutting down collector..."))
+}
+
+func (suite *LoggerTestSuite) TestCompressionRejected() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Logger = logger
+	s := NewStride("key", config)
+
+	// Repeated rejections are rate limited like other errors
+	for i := 0; i < 3; i++ {
+		s.Post("/collect/s0", []map[string]interface{}{{"x": i}})
+	}
+	warnings := 0
+	for _, line := range logger.lines {
+		if line.msg == "Stride API rejected compressed request body, check that it supports the Content-Encoding" {
+			assert.Equal(suite.T(), "warn", line.level)
+			warnings++
+		}
+	}
+	assert.Equal(suite.T(), 1, warnings)
+}
+
+func (suite *LoggerTestSuite) TestCollectorSummary() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	logger := &mockLogger{}
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.Logger = logger
+	assert.False(suite.T(), config.LogSummary)
+	config.LogSummary = true
+
+	collector := NewCollector("deadbeef", config)
+	event := map[string]interface{}{"name": "Kelsey Jannings"}
+	collector.Collect("s0", event, event)
+	collector.Collect("s1", event)
+	collector.Close()
+	<-rchan
+
+	line := logger.find("Collector shut down")
+	assert.NotNil(suite.T(), line)
+	assert.Equal(suite.T(), "info", line.level)
+	assert.Equal(suite.T(), int64(3), line.fields["collected"])
+	assert.Equal(suite.T(), int64(3), line.fields["delivered"])
+	assert.Equal(suite.T(), int64(0), line.fields["failed"])
+	assert.Equal(suite.T(), int64(0), line.fields["dropped"])
+	assert.True(suite.T(), line.fields["bytes_sent"].(int64) > 0)
+
+	collector.Collect("s0", event)
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(4), stats.Collected)
+	assert.Equal(suite.T(), int64(1), stats.Dropped)
+
+	logger = &mockLogger{}
+	config.Logger = logger
+	config.LogSummary = false
+	NewCollector("deadbeef", config).Close()
+	assert.Nil(suite.T(), logger.find("Collector shut down"))
+}
+
+func TestLoggerTestSuite(t *testing.T) {
+	suite.Run(t, new(LoggerTestSuite))
+}
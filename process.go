@@ -0,0 +1,94 @@
+package stride
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalidAction is returned when a process' action is misconfigured
+var ErrInvalidAction = errors.New("Invalid process action")
+
+// ActionType is the type of action a process performs on its query's output
+type ActionType string
+
+const (
+	// ActionMaterialize incrementally maintains the query's results
+	ActionMaterialize ActionType = "MATERIALIZE"
+	// ActionWebhook POSTs the query's output to a URL
+	ActionWebhook ActionType = "WEBHOOK"
+)
+
+// Action is the action a process performs on its query's output
+type Action struct {
+	Type ActionType `json:"type"`
+
+	// URL is the destination of a WEBHOOK action
+	URL string `json:"url,omitempty"`
+}
+
+// Validate checks that the action's fields are valid for its type
+func (a *Action) Validate() error {
+	switch a.Type {
+	case ActionMaterialize:
+		if a.URL != "" {
+			return ErrInvalidAction
+		}
+	case ActionWebhook:
+		if a.URL == "" {
+			return ErrInvalidAction
+		}
+	default:
+		return ErrInvalidAction
+	}
+
+	return nil
+}
+
+// UnmarshalJSON decodes an action from either its object form or the bare
+// action type shorthand, e.g. "MATERIALIZE"
+func (a *Action) UnmarshalJSON(b []byte) error {
+	var t string
+	if err := json.Unmarshal(b, &t); err == nil {
+		*a = Action{Type: ActionType(t)}
+		return nil
+	}
+
+	// Avoid recursing into UnmarshalJSON
+	type action Action
+	var v action
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = Action(v)
+
+	return nil
+}
+
+// ProcessSpec is a continuous query over streams, along with its action
+type ProcessSpec struct {
+	Query  string `json:"query"`
+	Action Action `json:"action"`
+}
+
+// CreateProcess validates the spec's action and creates a process with the
+// given name from it
+func (s *Stride) CreateProcess(name string, spec ProcessSpec) (*Response, error) {
+	if err := spec.Action.Validate(); err != nil {
+		return &Response{StatusCode: -1, Error: err}, err
+	}
+
+	r := s.Post("/process/"+name, &spec)
+	return r, r.Error
+}
+
+// GetProcess returns the process with the given name
+func (s *Stride) GetProcess(name string) (*Response, error) {
+	r := s.Get("/process/" + name)
+	return r, r.Error
+}
+
+// DeleteProcess deletes the process with the given name
+func (s *Stride) DeleteProcess(name string) (*Response, error) {
+	r := s.Delete("/process/" + name)
+	return r, r.Error
+}
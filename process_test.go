@@ -0,0 +1,94 @@
+package stride
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProcessTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ProcessTestSuite) TestActionValidation() {
+	assert.Nil(suite.T(), (&Action{Type: ActionMaterialize}).Validate())
+	assert.Nil(suite.T(), (&Action{Type: ActionWebhook, URL: "https://example.com"}).Validate())
+
+	assert.Equal(suite.T(), ErrInvalidAction, (&Action{}).Validate())
+	assert.Equal(suite.T(), ErrInvalidAction, (&Action{Type: "MAGIC"}).Validate())
+	assert.Equal(suite.T(), ErrInvalidAction, (&Action{Type: ActionWebhook}).Validate())
+	assert.Equal(suite.T(), ErrInvalidAction, (&Action{Type: ActionMaterialize, URL: "https://example.com"}).Validate())
+}
+
+func (suite *ProcessTestSuite) TestActionJSON() {
+	var p ProcessSpec
+	err := json.Unmarshal([]byte(`{"query": "SELECT 1", "action": {"type": "MATERIALIZE"}}`), &p)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), Action{Type: ActionMaterialize}, p.Action)
+
+	err = json.Unmarshal([]byte(`{"query": "SELECT 1", "action": "MATERIALIZE"}`), &p)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), Action{Type: ActionMaterialize}, p.Action)
+
+	b, _ := json.Marshal(&Action{Type: ActionWebhook, URL: "https://example.com"})
+	assert.Equal(suite.T(), `{"type":"WEBHOOK","url":"https://example.com"}`, string(b))
+}
+
+func (suite *ProcessTestSuite) TestCreateProcess() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	s := NewStride("key", config)
+
+	r, err := s.CreateProcess("p1", ProcessSpec{
+		Query:  "SELECT 1",
+		Action: Action{Type: ActionMaterialize},
+	})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), http.StatusCreated, r.StatusCode)
+	assert.Equal(suite.T(), map[string]interface{}{
+		"query":  "SELECT 1",
+		"action": map[string]interface{}{"type": "MATERIALIZE"},
+	}, r.Data)
+
+	r, err = s.CreateProcess("p1", ProcessSpec{Query: "SELECT 1"})
+	assert.Equal(suite.T(), ErrInvalidAction, err)
+	assert.Equal(suite.T(), ErrInvalidAction, r.Error)
+}
+
+func (suite *ProcessTestSuite) TestProcessLifecycle() {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	_, err := s.GetProcess("p1")
+	assert.Nil(suite.T(), err)
+	_, err = s.DeleteProcess("p1")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"GET /process/p1", "DELETE /process/p1"}, requests)
+
+	_, err = s.GetProcess("p1/stats/x")
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+	_, err = s.DeleteProcess("")
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+	_, err = s.CreateProcess("p1/stats/x", ProcessSpec{Action: Action{Type: ActionMaterialize}})
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+	assert.Len(suite.T(), requests, 2)
+}
+
+func TestProcessTestSuite(t *testing.T) {
+	suite.Run(t, new(ProcessTestSuite))
+}
@@ -0,0 +1,84 @@
+package stride
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// RateLimitLimitHeader is the response header with the number of requests
+	// allowed per rate limit window
+	RateLimitLimitHeader = "X-RateLimit-Limit"
+	// RateLimitRemainingHeader is the response header with the number of
+	// requests left in the current window
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// RateLimitResetHeader is the response header with the Unix time in seconds
+	// at which the current window ends
+	RateLimitResetHeader = "X-RateLimit-Reset"
+)
+
+// RetryAfterHeader is the response header with how long to wait before
+// retrying a request that was rate limited
+const RetryAfterHeader = "Retry-After"
+
+// RateLimit is the state of the API key's rate limit as of a response
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// Exhausted returns whether no requests are left until Reset
+func (r *RateLimit) Exhausted() bool {
+	return r.Remaining <= 0 && time.Now().Before(r.Reset)
+}
+
+// parseRateLimit returns the rate limit of a response, or nil if it has no
+// valid rate limit headers
+func parseRateLimit(h http.Header) *RateLimit {
+	limit, err := strconv.Atoi(h.Get(RateLimitLimitHeader))
+	if err != nil {
+		return nil
+	}
+	remaining, err := strconv.Atoi(h.Get(RateLimitRemainingHeader))
+	if err != nil {
+		return nil
+	}
+	reset, err := strconv.ParseInt(h.Get(RateLimitResetHeader), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	return &RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+}
+
+// parseRetryAfter returns how long after now the RetryAfterHeader asks to wait,
+// given either in seconds or as an HTTP-date, and whether the header was set
+// and valid
+func parseRetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get(RetryAfterHeader)
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if wait := t.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
@@ -0,0 +1,73 @@
+package stride
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RateLimitTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RateLimitTestSuite) TestParseRateLimit() {
+	h := http.Header{}
+	assert.Nil(suite.T(), parseRateLimit(h))
+
+	h.Set(RateLimitLimitHeader, "100")
+	h.Set(RateLimitRemainingHeader, "42")
+	h.Set(RateLimitResetHeader, "1473670800")
+	assert.Equal(suite.T(), &RateLimit{
+		Limit:     100,
+		Remaining: 42,
+		Reset:     time.Unix(1473670800, 0),
+	}, parseRateLimit(h))
+
+	h.Set(RateLimitResetHeader, "soon")
+	assert.Nil(suite.T(), parseRateLimit(h))
+}
+
+func (suite *RateLimitTestSuite) TestExhausted() {
+	rl := &RateLimit{Limit: 100, Remaining: 1, Reset: time.Now().Add(time.Minute)}
+	assert.False(suite.T(), rl.Exhausted())
+	rl.Remaining = 0
+	assert.True(suite.T(), rl.Exhausted())
+	rl.Reset = time.Now().Add(-time.Second)
+	assert.False(suite.T(), rl.Exhausted())
+}
+
+func (suite *RateLimitTestSuite) TestParseRetryAfter() {
+	now := time.Date(2016, time.September, 12, 9, 0, 0, 0, time.UTC)
+	h := http.Header{}
+	_, ok := parseRetryAfter(h, now)
+	assert.False(suite.T(), ok)
+
+	h.Set(RetryAfterHeader, "120")
+	wait, ok := parseRetryAfter(h, now)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 2*time.Minute, wait)
+
+	h.Set(RetryAfterHeader, "Mon, 12 Sep 2016 09:00:30 GMT")
+	wait, ok = parseRetryAfter(h, now)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), 30*time.Second, wait)
+
+	// A date in the past means retrying right away
+	h.Set(RetryAfterHeader, "Mon, 12 Sep 2016 08:59:00 GMT")
+	wait, ok = parseRetryAfter(h, now)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), time.Duration(0), wait)
+
+	for _, v := range []string{"-1", "soon"} {
+		h.Set(RetryAfterHeader, v)
+		_, ok = parseRetryAfter(h, now)
+		assert.False(suite.T(), ok)
+	}
+}
+
+func TestRateLimitTestSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitTestSuite))
+}
@@ -0,0 +1,141 @@
+package stride
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordedRequest is a single Collect call captured by a recorder
+type recordedRequest struct {
+	Time     time.Time                `json:"time"`
+	Stream   string                   `json:"stream"`
+	Events   []map[string]interface{} `json:"events"`
+	Deadline *time.Time               `json:"deadline,omitempty"`
+
+	// Endpoints that still have to accept spilled events, if not all of them
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// encodeRequest writes req to enc as recordedRequests captured at now, one per
+// stream, returning the first error
+func encodeRequest(enc *json.Encoder, req collectRequest, now time.Time) error {
+	var first error
+	req.each(func(stream string, events []map[string]interface{}) {
+		rec := recordedRequest{
+			Time:      now,
+			Stream:    stream,
+			Events:    events,
+			Endpoints: req.endpoints,
+		}
+		if !req.deadline.IsZero() {
+			rec.Deadline = &req.deadline
+		}
+
+		if err := enc.Encode(rec); err != nil && first == nil {
+			first = err
+		}
+	})
+	return first
+}
+
+// request returns the Collect call captured by rec
+func (rec *recordedRequest) request() collectRequest {
+	req := collectRequest{stream: rec.Stream, events: rec.Events, endpoints: rec.Endpoints}
+	if rec.Deadline != nil {
+		req.deadline = *rec.Deadline
+	}
+	return req
+}
+
+// recorder writes every Collect call of a Collector to a file as
+// newline-delimited JSON, so that the session can be replayed later
+type recorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	logger Logger
+}
+
+func newRecorder(path string, logger Logger) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{file: f, enc: json.NewEncoder(f), logger: logger}, nil
+}
+
+func (r *recorder) record(req collectRequest) {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if err := encodeRequest(r.enc, req, now); err != nil {
+		newEntry(r.logger, Fields{
+			"module":   "recorder",
+			"function": "record",
+		}).WithError(err).Error("Failed to record collected events")
+	}
+}
+
+func (r *recorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Replay re-collects the events of a session recorded with
+// CollectorConfig.RecordPath, preserving the time elapsed between the original
+// Collect calls. It returns the first error collecting the events, stopping
+// with ErrCollectorClosed if the collector closes along the way.
+func (c *Collector) Replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var last time.Time
+	var first error
+	for {
+		var rec recordedRequest
+		if err := dec.Decode(&rec); err == io.EOF {
+			return first
+		} else if err != nil {
+			return err
+		}
+
+		if !last.IsZero() {
+			select {
+			case <-time.After(rec.Time.Sub(last)):
+			case <-c.tomb.Dying():
+				return ErrCollectorClosed
+			}
+		}
+		last = rec.Time
+
+		err := c.enqueue(rec.request())
+		if err == ErrCollectorClosed {
+			return err
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package stride
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RecorderTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RecorderTestSuite) TestRecordReplay() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.ndjson")
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 50 * time.Millisecond
+	config.Endpoint = server.URL
+	config.RecordPath = path
+
+	event := map[string]interface{}{"name": "Wanda Pierce"}
+	deadline := time.Date(2016, time.October, 3, 22, 19, 51, 0, time.UTC)
+
+	collector := NewCollector("deadbeef", config)
+	collector.Collect("s0", event)
+	<-rchan
+	collector.CollectWithDeadline("s1", deadline, event, event)
+	<-rchan
+	collector.Close()
+
+	config = NewCollectorConfig()
+	config.FlushInterval = 50 * time.Millisecond
+	config.Endpoint = server.URL
+
+	replay := NewCollector("deadbeef", config)
+	defer replay.Close()
+	assert.Nil(suite.T(), replay.Replay(path))
+
+	request := <-rchan
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{event},
+	}, request.body)
+
+	request = <-rchan
+	assert.Equal(suite.T(), "2016-10-03T22:19:51Z", request.header.Get(DeadlineHeader))
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s1": []interface{}{event, event},
+	}, request.body)
+}
+
+func (suite *RecorderTestSuite) TestReplayErrors() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.ndjson")
+
+	now := time.Now()
+	f, _ := os.Create(path)
+	enc := json.NewEncoder(f)
+	for _, name := range []string{"$reserved", "name", "name"} {
+		enc.Encode(recordedRequest{
+			Time:   now,
+			Stream: "s0",
+			Events: []map[string]interface{}{{name: "Kelsey Jannings"}},
+		})
+	}
+	f.Close()
+
+	config := NewCollectorConfig()
+	config.FlushInterval = 50 * time.Millisecond
+	config.Endpoint = server.URL
+	config.ValidateEvents = true
+
+	// The invalid event is reported, and the valid ones are collected anyway
+	replay := NewCollector("deadbeef", config)
+	err := replay.Replay(path)
+	assert.IsType(suite.T(), &BodyError{}, err)
+	assert.Equal(suite.T(), ErrReservedKey, err.(*BodyError).Err)
+	request := <-rchan
+	assert.Equal(suite.T(), 2, len(request.body["s0"].([]interface{})))
+	replay.Close()
+
+	// Replaying into a closed collector stops at the first event
+	assert.Equal(suite.T(), ErrCollectorClosed, replay.Replay(path))
+	assert.Equal(suite.T(), int64(1), replay.Stats().Dropped)
+}
+
+func TestRecorderTestSuite(t *testing.T) {
+	suite.Run(t, new(RecorderTestSuite))
+}
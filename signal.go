@@ -0,0 +1,118 @@
+package stride
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// shutdownSignals are the signals that close collectors with FlushOnSignal
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// signalHandler is the single handler shared by every collector with
+// FlushOnSignal. It's installed along with the first of them, and removed once
+// the last one shuts down or stops watching signals.
+var signalHandler struct {
+	mu         sync.Mutex
+	ch         chan os.Signal
+	collectors map[*Collector]bool
+}
+
+// raiseSignal delivers sig to the process again once the handler is removed,
+// so that it's interrupted or terminated as it would have been without it
+var raiseSignal = func(sig os.Signal) {
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Signal(sig)
+	}
+}
+
+func watchSignals(c *Collector) {
+	signalHandler.mu.Lock()
+	defer signalHandler.mu.Unlock()
+
+	if signalHandler.ch == nil {
+		signalHandler.ch = make(chan os.Signal, 1)
+		signalHandler.collectors = make(map[*Collector]bool)
+		signal.Notify(signalHandler.ch, shutdownSignals...)
+		go handleSignals(signalHandler.ch)
+	}
+	signalHandler.collectors[c] = true
+}
+
+func unwatchSignals(c *Collector) {
+	signalHandler.mu.Lock()
+	defer signalHandler.mu.Unlock()
+
+	if signalHandler.ch == nil || !signalHandler.collectors[c] {
+		return
+	}
+	delete(signalHandler.collectors, c)
+	if len(signalHandler.collectors) == 0 {
+		signal.Stop(signalHandler.ch)
+		close(signalHandler.ch)
+		signalHandler.ch = nil
+	}
+}
+
+// handleSignals closes the watching collectors once a shutdown signal arrives
+// on ch, and then removes the handler and raises the signal again
+func handleSignals(ch chan os.Signal) {
+	sig, ok := <-ch
+	if !ok {
+		return
+	}
+
+	signalHandler.mu.Lock()
+	var collectors []*Collector
+	if signalHandler.ch == ch {
+		for c := range signalHandler.collectors {
+			collectors = append(collectors, c)
+		}
+		signal.Stop(ch)
+		signalHandler.ch = nil
+		signalHandler.collectors = nil
+	}
+	signalHandler.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range collectors {
+		wg.Add(1)
+		go func(c *Collector) {
+			defer wg.Done()
+			c.closeOnSignal(sig)
+		}(c)
+	}
+	wg.Wait()
+
+	raiseSignal(sig)
+}
+
+// closeOnSignal shuts the collector down within SignalTimeout
+func (c *Collector) closeOnSignal(sig os.Signal) {
+	lg := newEntry(c.logger, Fields{
+		"module": "collector",
+		"signal": sig.String(),
+	})
+
+	ctx := context.Background()
+	if c.config.SignalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.SignalTimeout)
+		defer cancel()
+	}
+
+	lg.Info("Closing collector on signal")
+	if err := c.CloseContext(ctx); err != nil {
+		lg.WithError(err).Warn("Collector didn't flush all events before the signal timeout")
+	}
+}
+
+// StopFlushOnSignal stops the collector from closing on SIGINT or SIGTERM if
+// it was created with FlushOnSignal, e.g. because the application has taken
+// over shutting it down. The signal handler is removed once no collector
+// needs it.
+func (c *Collector) StopFlushOnSignal() {
+	unwatchSignals(c)
+}
@@ -0,0 +1,113 @@
+package stride
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SignalTestSuite struct {
+	suite.Suite
+	raised chan os.Signal
+
+	// The real raiseSignal, restored after each test
+	raiseSignal func(sig os.Signal)
+}
+
+func (suite *SignalTestSuite) SetupTest() {
+	suite.raised = make(chan os.Signal, 1)
+	suite.raiseSignal = raiseSignal
+	raiseSignal = func(sig os.Signal) {
+		suite.raised <- sig
+	}
+}
+
+func (suite *SignalTestSuite) TearDownTest() {
+	raiseSignal = suite.raiseSignal
+}
+
+// handler returns the signal handler's channel and number of collectors
+func handler() (chan os.Signal, int) {
+	signalHandler.mu.Lock()
+	defer signalHandler.mu.Unlock()
+	return signalHandler.ch, len(signalHandler.collectors)
+}
+
+func (suite *SignalTestSuite) TestFlushOnSignal() {
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config := NewCollectorConfig()
+	config.Endpoint = server.URL
+	config.FlushInterval = time.Hour
+	config.FlushOnSignal = true
+
+	c1 := NewCollector("deadbeef", config)
+	c2 := NewCollector("deadbeef", config)
+	unwatched := NewCollector("deadbeef", NewCollectorConfig())
+	defer unwatched.Close()
+
+	// A single handler is shared by both collectors
+	ch, n := handler()
+	assert.NotNil(suite.T(), ch)
+	assert.Equal(suite.T(), 2, n)
+
+	event := map[string]interface{}{"name": "Hollyhock"}
+	c1.Collect("s0", event)
+	c2.Collect("s1", event)
+	unwatched.Collect("s2", event)
+	ch <- syscall.SIGTERM
+
+	// Both flush their events before the signal is raised again
+	bodies := []map[string]interface{}{(<-rchan).body, (<-rchan).body}
+	assert.Contains(suite.T(), bodies, map[string]interface{}{"s0": []interface{}{event}})
+	assert.Contains(suite.T(), bodies, map[string]interface{}{"s1": []interface{}{event}})
+	assert.Equal(suite.T(), syscall.SIGTERM, <-suite.raised)
+	assert.Equal(suite.T(), ErrCollectorClosed, c1.Collect("s0", event))
+	assert.Equal(suite.T(), ErrCollectorClosed, c2.Collect("s1", event))
+	assert.Nil(suite.T(), unwatched.Collect("s2", event))
+
+	ch, _ = handler()
+	assert.Nil(suite.T(), ch)
+}
+
+func (suite *SignalTestSuite) TestStopFlushOnSignal() {
+	config := NewCollectorConfig()
+	config.FlushOnSignal = true
+
+	c1 := NewCollector("deadbeef", config)
+	c2 := NewCollector("deadbeef", config)
+	defer c2.Close()
+
+	c1.StopFlushOnSignal()
+	_, n := handler()
+	assert.Equal(suite.T(), 1, n)
+	// Closing a collector that stopped watching is fine
+	c1.Close()
+
+	// The handler is removed along with the last collector
+	ch, _ := handler()
+	c2.StopFlushOnSignal()
+	_, open := <-ch
+	assert.False(suite.T(), open)
+	ch, n = handler()
+	assert.Nil(suite.T(), ch)
+	assert.Equal(suite.T(), 0, n)
+
+	// And installed again for the next one
+	c3 := NewCollector("deadbeef", config)
+	ch, n = handler()
+	assert.NotNil(suite.T(), ch)
+	assert.Equal(suite.T(), 1, n)
+	c3.Close()
+	ch, _ = handler()
+	assert.Nil(suite.T(), ch)
+}
+
+func TestSignalTestSuite(t *testing.T) {
+	suite.Run(t, new(SignalTestSuite))
+}
@@ -0,0 +1,175 @@
+package stride
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// spiller appends the events that a shutting down collector failed to send to
+// a file as newline-delimited JSON, in the same format as a recording, so that
+// Recover can collect them again after a restart
+type spiller struct {
+	mu     sync.Mutex
+	path   string
+	logger Logger
+}
+
+func newSpiller(path string, logger Logger) *spiller {
+	return &spiller{path: path, logger: logger}
+}
+
+// spill appends the events of req to the file. It's opened for each spill
+// rather than held open, since events left in the buffer when draining timed
+// out may still be spilled after the collector shut down.
+func (s *spiller) spill(req collectRequest) {
+	lg := newEntry(s.logger, Fields{
+		"module":   "collector",
+		"function": "spill",
+		"path":     s.path,
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		lg.WithError(err).Error("Failed to spill unsent events")
+		return
+	}
+	defer f.Close()
+
+	if err := encodeRequest(json.NewEncoder(f), req, time.Now()); err != nil {
+		lg.WithError(err).Error("Failed to spill unsent events")
+		return
+	}
+
+	lg.WithField("num_events", req.size()).Warn("Spilled unsent events to disk")
+}
+
+// Recover sends the events spilled to path by a collector with
+// CollectorConfig.SpillPath, e.g. by the previous run of the process, in
+// batches of up to BatchSize events, waiting for each to be sent. It returns
+// nil if there's no file to recover. The file is removed once every batch was
+// sent, or else rewritten with the batches that failed, and the first error is
+// returned. Those events are recovered again by the next call, and may be sent
+// twice. Events that only some of the mirror endpoints failed to accept are
+// sent to just those.
+func (c *Collector) Recover(path string) error {
+	if c.isClosed() {
+		return ErrCollectorClosed
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var recs []recordedRequest
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec recordedRequest
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		recs = append(recs, rec)
+	}
+	f.Close()
+
+	var failed []collectRequest
+	var first error
+	send := func(b *batch) {
+		if b.size == 0 {
+			return
+		}
+		if err := c.send(b); err != nil {
+			if first == nil {
+				first = err
+			}
+			failed = append(failed, collectRequest{
+				streams:   b.events,
+				deadline:  b.deadline,
+				endpoints: failedEndpoints(err),
+			})
+		}
+	}
+
+	b := newBatch()
+	for _, rec := range recs {
+		req := rec.request()
+		atomic.AddInt64(&c.collected, int64(req.size()))
+		if len(req.endpoints) > 0 {
+			send(c.partialBatch(req))
+			continue
+		}
+
+		if c.config.ValidateEvents {
+			var err error
+			if req.events, err = c.validate(req.stream, req.events); err != nil {
+				// Events that will never be accepted are dropped rather than
+				// recovered again
+				newEntry(c.logger, Fields{
+					"module":   "collector",
+					"function": "Recover",
+					"path":     path,
+					"stream":   rec.Stream,
+				}).WithError(err).Error("Failed to recover spilled events")
+			}
+			if len(req.events) == 0 {
+				continue
+			}
+		}
+		b.add(req, time.Now())
+		if b.size >= c.config.BatchSize {
+			send(b)
+			b = newBatch()
+		}
+	}
+	send(b)
+
+	// A shutdown cut the sends short, so the events may have been spilled again
+	if !c.tomb.Alive() {
+		return ErrCollectorClosed
+	}
+	if len(failed) > 0 {
+		if err := rewriteSpill(path, failed); err != nil {
+			return err
+		}
+		return first
+	}
+	return os.Remove(path)
+}
+
+// rewriteSpill replaces the file at path with the events of reqs, through a
+// temporary file so that the events already in it aren't lost if that fails
+func rewriteSpill(path string, reqs []collectRequest) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	now := time.Now()
+	for _, req := range reqs {
+		if err := encodeRequest(enc, req, now); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
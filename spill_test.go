@@ -0,0 +1,195 @@
+package stride
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SpillTestSuite struct {
+	suite.Suite
+}
+
+func (suite *SpillTestSuite) TestSpillRecover() {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill.ndjson")
+
+	config := NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = down.URL
+	config.SpillPath = path
+
+	event := map[string]interface{}{"name": "Princess Carolyn"}
+	deadline := time.Date(2016, time.October, 3, 22, 19, 51, 0, time.UTC)
+
+	collector := NewCollector("deadbeef", config)
+
+	// Failures while running are left to OnError and the like
+	collector.Collect("s0", event)
+	assert.NotNil(suite.T(), collector.Flush())
+	_, err := os.Stat(path)
+	assert.True(suite.T(), os.IsNotExist(err))
+
+	collector.Collect("s0", event)
+	collector.CollectWithDeadline("s1", deadline, event, event)
+	collector.Close()
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, strings.Count(string(b), "\n"))
+
+	server, rchan := createMockCollectServer()
+	defer server.Close()
+
+	config = NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = server.URL
+
+	recovered := NewCollector("deadbeef", config)
+	assert.Nil(suite.T(), recovered.Recover(path))
+	_, err = os.Stat(path)
+	assert.True(suite.T(), os.IsNotExist(err))
+	assert.Nil(suite.T(), recovered.Flush())
+
+	request := <-rchan
+	assert.Equal(suite.T(), "2016-10-03T22:19:51Z", request.header.Get(DeadlineHeader))
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{event},
+		"s1": []interface{}{event, event},
+	}, request.body)
+
+	// Nothing left to recover
+	assert.Nil(suite.T(), recovered.Recover(path))
+	recovered.Close()
+	assert.Equal(suite.T(), ErrCollectorClosed, recovered.Recover(path))
+}
+
+func (suite *SpillTestSuite) TestRecoverFlushFailed() {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill.ndjson")
+	ioutil.WriteFile(path, []byte("{\"stream\": \"s0\", \"events\": [{}]}\n"), 0644)
+
+	config := NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = down.URL
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// The file is kept until its events were sent
+	assert.NotNil(suite.T(), collector.Recover(path))
+	_, err := os.Stat(path)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), collector.Stats().Failed)
+}
+
+func (suite *SpillTestSuite) TestRecoverPartialFailure() {
+	var failing int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, _ := gzip.NewReader(r.Body)
+		var batch map[string]interface{}
+		json.NewDecoder(gz).Decode(&batch)
+		if _, ok := batch["s1"]; ok && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill.ndjson")
+	ioutil.WriteFile(path, []byte(
+		"{\"stream\": \"s0\", \"events\": [{}]}\n"+
+			"{\"stream\": \"s1\", \"events\": [{}]}\n"+
+			"{\"stream\": \"s2\", \"events\": [{}]}\n"), 0644)
+
+	config := NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = server.URL
+	config.BatchSize = 1
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// Only the batch that failed is kept
+	assert.Equal(suite.T(), ErrServerError, collector.Recover(path))
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 1, strings.Count(string(b), "\n"))
+	assert.Contains(suite.T(), string(b), `"stream":"s1"`)
+	stats := collector.Stats()
+	assert.Equal(suite.T(), int64(2), stats.Delivered)
+	assert.Equal(suite.T(), int64(1), stats.Failed)
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Nil(suite.T(), collector.Recover(path))
+	_, err = os.Stat(path)
+	assert.True(suite.T(), os.IsNotExist(err))
+	assert.Equal(suite.T(), int64(3), collector.Stats().Delivered)
+}
+
+func (suite *SpillTestSuite) TestRecoverMirrorEndpoints() {
+	primary, pchan := createMockCollectServer()
+	defer primary.Close()
+	mirror, mchan := createMockCollectServer()
+	defer mirror.Close()
+
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill.ndjson")
+	ioutil.WriteFile(path, []byte("{\"stream\": \"s0\", \"events\": [{}], \"endpoints\": [\""+mirror.URL+"\"]}\n"), 0644)
+
+	config := NewCollectorConfig()
+	config.FlushInterval = time.Hour
+	config.Endpoint = primary.URL
+	config.MirrorEndpoints = []string{mirror.URL}
+	collector := NewCollector("deadbeef", config)
+	defer collector.Close()
+
+	// Only the mirror that failed to accept the events gets them again
+	assert.Nil(suite.T(), collector.Recover(path))
+	assert.Equal(suite.T(), map[string]interface{}{"s0": []interface{}{map[string]interface{}{}}}, (<-mchan).body)
+	assert.Equal(suite.T(), 0, len(pchan))
+	assert.Equal(suite.T(), int64(1), collector.Stats().Delivered)
+}
+
+func (suite *SpillTestSuite) TestRecoverInvalid() {
+	dir, _ := ioutil.TempDir("", "gostride")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill.ndjson")
+	ioutil.WriteFile(path, []byte("{\"stream\": \"s0\", \"events\": [{}]}\nnope\n"), 0644)
+
+	collector := NewCollector("deadbeef", NewCollectorConfig())
+	defer collector.Close()
+
+	// The file is kept for another attempt
+	assert.NotNil(suite.T(), collector.Recover(path))
+	_, err := os.Stat(path)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), collector.Stats().Collected)
+}
+
+func TestSpillTestSuite(t *testing.T) {
+	suite.Run(t, new(SpillTestSuite))
+}
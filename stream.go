@@ -0,0 +1,72 @@
+package stride
+
+import "context"
+
+// Stream is a convenience wrapper around the /collect endpoints of a single
+// stream
+type Stream struct {
+	name   string
+	path   string
+	stride *Stride
+}
+
+// Stream returns a Stream with the given name
+func (s *Stride) Stream(name string) *Stream {
+	return &Stream{
+		name:   name,
+		path:   "/collect/" + name,
+		stride: s,
+	}
+}
+
+// ListStreams returns the names of all streams
+func (s *Stride) ListStreams() ([]string, error) {
+	return s.ListStreamsContext(context.Background())
+}
+
+// ListStreamsContext returns the names of all streams, bound by ctx. It returns
+// ErrInvalidResponse if the response isn't a list of names.
+func (s *Stride) ListStreamsContext(ctx context.Context) ([]string, error) {
+	r := s.GetContext(ctx, "/collect")
+	if r.Error != nil {
+		return nil, r.Error
+	}
+
+	items, ok := r.Data.([]interface{})
+	if !ok {
+		return nil, ErrInvalidResponse
+	}
+	names := make([]string, len(items))
+	for i, item := range items {
+		if names[i], ok = item.(string); !ok {
+			return nil, ErrInvalidResponse
+		}
+	}
+
+	return names, nil
+}
+
+// Name returns the name of the stream
+func (st *Stream) Name() string {
+	return st.name
+}
+
+// Collect synchronously writes events to the stream
+func (st *Stream) Collect(events ...map[string]interface{}) *Response {
+	return st.stride.Post(st.path, events)
+}
+
+// Subscribe returns a Subscription to the stream's events
+func (st *Stream) Subscribe() (*Subscription, error) {
+	return st.stride.Subscribe(st.path)
+}
+
+// Delete deletes the stream
+func (st *Stream) Delete() *Response {
+	return st.stride.Delete(st.path)
+}
+
+// Stats returns the stream's details, including its statistics
+func (st *Stream) Stats() *Response {
+	return st.stride.Get(st.path)
+}
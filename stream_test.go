@@ -0,0 +1,83 @@
+package stride
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type StreamTestSuite struct {
+	suite.Suite
+}
+
+func (suite *StreamTestSuite) TestStream() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	s := NewStride("key", config)
+	stream := s.Stream("stream")
+	assert.Equal(suite.T(), "stream", stream.Name())
+
+	event := map[string]interface{}{"x": "x"}
+	r := stream.Collect(event, event)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusCreated, r.StatusCode)
+	assert.Equal(suite.T(), []interface{}{event, event}, r.Data)
+
+	r = stream.Stats()
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+
+	r = stream.Delete()
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+
+	sub, err := stream.Subscribe()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "/collect/stream", sub.path)
+
+	invalid := s.Stream("1stream")
+	assert.Equal(suite.T(), ErrInvalidPath, invalid.Collect(event).Error)
+	_, err = invalid.Subscribe()
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+}
+
+func (suite *StreamTestSuite) TestListStreams() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	names, err := NewStride("key", config).ListStreams()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"stream0", "stream1"}, names)
+
+	body := `[]`
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer other.Close()
+	config.Endpoint = other.URL
+	s := NewStride("key", config)
+
+	names, err = s.ListStreams()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{}, names)
+
+	for _, body = range []string{`{"streams": []}`, `["stream0", 1]`, `null`} {
+		names, err = s.ListStreams()
+		assert.Equal(suite.T(), ErrInvalidResponse, err, body)
+		assert.Nil(suite.T(), names)
+	}
+}
+
+func TestStreamTestSuite(t *testing.T) {
+	suite.Run(t, new(StreamTestSuite))
+}
@@ -2,31 +2,42 @@ package stride
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"golang.org/x/time/rate"
 )
 
-var log = logrus.New()
-
 const (
 	// Version of client library
 	Version = "0.1"
 	// Endpoint for Stride API
 	Endpoint = "https://api.stride.com/v1"
 
-	// Timestamp is the key to be used for the event timestamp
-	Timestamp = "$timestamp"
-	// ID is the key to be used for the event ID
-	ID = "$id"
+	// IdempotencyKeyHeader is the request header carrying an idempotency key
+	IdempotencyKeyHeader = "Idempotency-Key"
 )
 
 var (
@@ -51,6 +62,116 @@ var (
 	ErrInvalidAPIKey = errors.New("Invalid API key")
 )
 
+// BodyError is the error of a request whose body failed to encode. It matches
+// ErrInvalidBody with errors.Is and unwraps to the encoder's error, e.g. a
+// *json.UnsupportedTypeError.
+type BodyError struct {
+	// Path to the offending value within the body, e.g. "[2].tags.f", if it
+	// could be determined
+	Path string
+	Err  error
+}
+
+func newBodyError(data interface{}, err error) *BodyError {
+	return &BodyError{
+		Path: strings.TrimPrefix(invalidPath(reflect.ValueOf(data)), "."),
+		Err:  err,
+	}
+}
+
+func (e *BodyError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s at %s: %s", ErrInvalidBody, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidBody, e.Err)
+}
+
+// Unwrap returns the encoder's error
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrInvalidBody
+func (e *BodyError) Is(target error) bool {
+	return target == ErrInvalidBody
+}
+
+// invalidPath returns the path to the innermost map or slice element of v that
+// fails to encode as JSON, or "" if there is none
+func invalidPath(v reflect.Value) string {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			elem := v.MapIndex(k)
+			if _, err := json.Marshal(elem.Interface()); err != nil {
+				return fmt.Sprintf(".%v", k.Interface()) + invalidPath(elem)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if _, err := json.Marshal(elem.Interface()); err != nil {
+				return fmt.Sprintf("[%d]", i) + invalidPath(elem)
+			}
+		}
+	}
+
+	return ""
+}
+
+// APIError is the error of a request that the Stride API responded to with an
+// unexpected status code. It matches the error for the status code, e.g.
+// ErrInvalidBody for a 400, with errors.Is.
+type APIError struct {
+	StatusCode int
+	Err        error
+
+	// Message from the response's error envelope, if it had one, and the raw
+	// response body
+	Message string
+	Body    []byte
+}
+
+func newAPIError(statusCode int, data interface{}, body []byte) *APIError {
+	e := &APIError{
+		StatusCode: statusCode,
+		Err:        errorFromStatusCode(statusCode),
+		Body:       body,
+	}
+	if envelope, ok := data.(map[string]interface{}); ok {
+		for _, key := range []string{"error", "message"} {
+			if msg, ok := envelope[key].(string); ok {
+				e.Message = msg
+				break
+			}
+		}
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s (%d): %s", e.Err, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s (%d)", e.Err, e.StatusCode)
+}
+
+// Is reports whether target is the error for the status code
+func (e *APIError) Is(target error) bool {
+	return target == e.Err
+}
+
 var collectPath = regexp.MustCompile(`^/collect`)
 var validPaths = map[string][]*regexp.Regexp{
 	http.MethodGet: {
@@ -64,6 +185,7 @@ var validPaths = map[string][]*regexp.Regexp{
 		regexp.MustCompile(`^/analyze/[A-Za-z][A-Za-z0-9_]*/results$`),
 	},
 	http.MethodPut:    {regexp.MustCompile(`^/(analyze|process)/[A-Za-z][A-Za-z0-9_]*$`)},
+	http.MethodPatch:  {regexp.MustCompile(`^/(analyze|process)/[A-Za-z][A-Za-z0-9_]*$`)},
 	http.MethodDelete: {regexp.MustCompile(`^/(collect|process|analyze)/[A-Za-z][A-Za-z0-9_]*$`)},
 	"Subscribe":       {regexp.MustCompile(`^/(collect|process)/[A-Za-z][A-Za-z0-9_]*$`)},
 }
@@ -77,6 +199,56 @@ func isPathValid(method, path string) bool {
 	return false
 }
 
+// AllowPath allows requests with the given method to paths matching pattern,
+// in addition to the paths the client knows of, e.g. for an endpoint added to
+// the Stride API since this version of the client. The pattern is a regular
+// expression that must match the whole path, relative to the Endpoint. The
+// method is an HTTP method, or "Subscribe" for Subscribe's paths.
+func (s *Stride) AllowPath(method, pattern string) error {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return err
+	}
+
+	s.pathsMu.Lock()
+	defer s.pathsMu.Unlock()
+	if s.paths == nil {
+		s.paths = make(map[string][]*regexp.Regexp)
+	}
+	s.paths[method] = append(s.paths[method], re)
+	return nil
+}
+
+// isPathValid returns whether the path is valid for the method, either by
+// default or per AllowPath
+func (s *Stride) isPathValid(method, path string) bool {
+	if isPathValid(method, path) {
+		return true
+	}
+
+	s.pathsMu.RLock()
+	defer s.pathsMu.RUnlock()
+	for _, re := range s.paths[method] {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isJSONContentType returns whether a Content-Type is JSON or empty
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
 func errorFromStatusCode(statusCode int) error {
 	var err error
 
@@ -98,27 +270,271 @@ func errorFromStatusCode(statusCode int) error {
 	return err
 }
 
+// IsRetryable returns whether err is a transient server or network fault, i.e.
+// ErrServerError, ErrTimeout or ErrRequestFailed, so that the request may
+// succeed if it's retried. Wrapped errors such as an *APIError or a
+// *HandshakeError are matched too.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrServerError) ||
+		errors.Is(err, ErrTimeout) ||
+		errors.Is(err, ErrRequestFailed)
+}
+
+// IsClientError returns whether err means the request itself is wrong, i.e.
+// ErrInvalidBody, ErrInvalidPath, ErrInvalidAPIKey or ErrResourceMissing, so
+// that retrying it can't succeed. Wrapped errors such as an *APIError or a
+// *BodyError are matched too.
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrInvalidBody) ||
+		errors.Is(err, ErrInvalidPath) ||
+		errors.Is(err, ErrInvalidAPIKey) ||
+		errors.Is(err, ErrResourceMissing)
+}
+
+// RequestMetrics describes a single request issued to the Stride API
+type RequestMetrics struct {
+	Method     string
+	Path       string
+	StatusCode int
+
+	// Bytes written to and read from the wire, after compression
+	BytesSent     int
+	BytesReceived int
+
+	// Content-Encoding the request body was sent with, empty if it wasn't
+	// compressed, and the compression level if known
+	ContentEncoding  string
+	CompressionLevel int
+
+	// How long the oldest and newest events of a collector batch were buffered
+	// before being flushed
+	OldestEventAge time.Duration
+	NewestEventAge time.Duration
+
+	// Times the request was re-issued after a transient failure
+	Retries int
+
+	// Hex-encoded SHA-256 of the uncompressed request body, if it was sent
+	Checksum string
+
+	// Rate limit reported by the response, if any
+	RateLimit *RateLimit
+}
+
+// Observer is called with the metrics of every request issued to the Stride API
+type Observer func(*RequestMetrics)
+
+// Tracer lets requests to the Stride API take part in distributed traces
+// without depending on a particular tracing library. StartSpan starts a span
+// named after the request, e.g. "POST /collect", as a child of any span in ctx,
+// and returns a context holding the new span along with a function that ends
+// it. The function is called once with the request's status code, or -1 if no
+// response was received, and its error, if any. Inject adds the headers that
+// propagate the span in ctx to the request's headers.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, func(statusCode int, err error))
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Encoder serializes a request body, returning the encoded body along with
+// the Content-Encoding it should be sent with, if any
+type Encoder func(data interface{}) ([]byte, string, error)
+
+// JSONEncoder encodes request bodies as JSON with encoding/json
+func JSONEncoder(data interface{}) ([]byte, string, error) {
+	b, err := json.Marshal(data)
+	return b, "", err
+}
+
+// GzipJSONEncoder encodes request bodies as gzip compressed JSON with
+// encoding/json
+func GzipJSONEncoder(data interface{}) ([]byte, string, error) {
+	b, err := compressJSON(StdCodec{}, data, nil)
+	return b, "gzip", err
+}
+
+// EncoderRule selects the Encoder used for request paths matching Pattern
+type EncoderRule struct {
+	Pattern *regexp.Regexp
+	Encoder Encoder
+}
+
+// Doer issues HTTP requests. *http.Client is the default implementation, but
+// any Doer can be set as a Config's or CollectorConfig's Client, e.g. a fake
+// that serves canned responses in tests.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
 // Config is the config for the Stride API client
 type Config struct {
 	Timeout  time.Duration
 	Endpoint string
+	Observer Observer
+
+	// RootCAs, if set, is the pool of root certificates the endpoint's TLS
+	// certificate chain is verified against instead of the system pool
+	RootCAs *x509.CertPool
+
+	// ErrorLogInterval is the minimum interval between repeated logs of the
+	// same error. Zero logs every occurrence.
+	ErrorLogInterval time.Duration
+
+	// LogFieldsFromContext extracts fields, e.g. trace or correlation IDs, from a
+	// request's context that are added to every log line for that request
+	LogFieldsFromContext func(context.Context) map[string]interface{}
+
+	// Encoders are matched in order against the request path, the first match
+	// determines how the request body is encoded. Paths matching no rule are
+	// encoded with CodecEncoder(Codec), except for /collect, whose events are
+	// compressed with GzipCodecEncoder(Codec).
+	Encoders []EncoderRule
+
+	// Codec encodes request bodies matching no Encoders rule, and decodes
+	// response bodies and Subscription events. It defaults to StdCodec.
+	Codec Codec
+
+	// Logger is where the client and its Subscriptions log to
+	Logger Logger
+
+	// UserAgent, e.g. "myapp/1.2", is appended to the User-Agent of the requests
+	// of the client and its Subscriptions, after the library's own token, to
+	// identify the app to the Stride API
+	UserAgent string
+
+	// Auth authenticates the requests of the client and its Subscriptions. It
+	// defaults to a BasicAuthenticator for the client's API key.
+	Auth Authenticator
 
+	// Tracer, if set, starts a span around every request, covering any retries,
+	// and around each connection attempt of a Subscription
+	Tracer Tracer
+
+	// Client, if set, issues the requests of the client and its Subscriptions
+	// instead of an *http.Client. Timeout, RootCAs and
+	// Subscription.ConnectTimeout only configure the default client, so they're
+	// ignored, although WithTimeout still bounds each request.
+	Client Doer
+
+	// DryRun encodes each request's body as usual, but logs the request at
+	// debug level instead of sending it, and returns a 200 Response without
+	// Data. Subscriptions are unaffected.
+	DryRun bool
+
+	// Subscription configures the backoff between reconnects. A Subscription
+	// stops with ErrTimeout once it has failed to reconnect for MaxElapsedTime,
+	// or keeps retrying if it's zero. Each interval is randomized by up to
+	// RandomizationFactor of itself in either direction, so that clients
+	// disconnected together don't all reconnect at once. A 429 response's
+	// Retry-After header, if any, is waited for instead of the interval, up to
+	// MaxInterval. That wait counts towards MaxElapsedTime too.
+	//
+	// BufferSize is the capacity of a Subscription's Events channel. With an
+	// unbuffered or full channel, a slow consumer stops the Subscription from
+	// reading its connection, which may lead the server to disconnect it. If
+	// DropOldest is set, a full buffer instead discards its oldest event to
+	// make room, so the connection keeps draining at the cost of losing events.
+	//
+	// MaxEventSize is the largest event in bytes a Subscription can receive.
+	// A larger event ends the connection, which is then re-established. Zero
+	// means bufio.MaxScanTokenSize, i.e. 64KB.
+	//
+	// ConnectTimeout bounds establishing a Subscription's connection, i.e. the
+	// TCP dial and TLS handshake, without bounding the stream that follows.
+	// Zero means no limit.
+	//
+	// Resume reconnects a Subscription from the Position of the last event it
+	// delivered, rather than only receiving the events sent after it
+	// reconnected, so that no events are lost to a reconnect if the server
+	// supports resuming.
+	//
+	// Filter, if set, is called with each event a Subscription receives, which
+	// is only delivered if it returns true, e.g. to pick out the event types of
+	// interest from a stream. Filtering happens client-side once the event was
+	// parsed, so it saves the work of handling an event but not of receiving
+	// it.
+	//
+	// Coalesce drops events identical to the immediately preceding event. If
+	// CoalesceKeys is set, events are compared on the values of those keys,
+	// otherwise they must be byte-identical.
+	//
+	// OnLive, if set, is called once a Subscription started with StartFrom has
+	// caught up with historical events and begins receiving live events.
 	Subscription struct {
+		InitialInterval     time.Duration
+		MaxInterval         time.Duration
+		MaxElapsedTime      time.Duration
+		RandomizationFactor float64
+		BufferSize          int
+		DropOldest          bool
+		MaxEventSize        int
+		ConnectTimeout      time.Duration
+		Resume              bool
+		Filter              func(event map[string]interface{}) bool
+		Coalesce            bool
+		CoalesceKeys        []string
+		OnLive              func()
+	}
+
+	// Retry re-issues requests that failed transiently, backing off
+	// exponentially between attempts. GET, PUT and DELETE requests, and POST
+	// and PATCH requests with an idempotency key, are retried on connection
+	// errors and 429, 503 and 504 responses. Other POST and PATCH requests are
+	// only retried when the connection couldn't be established. A 429's
+	// Retry-After header, if any, is waited for instead of the backoff, up to
+	// MaxInterval. A request isn't retried if its context's deadline would pass
+	// during the wait. Disabled if MaxRetries is 0.
+	Retry struct {
+		MaxRetries      int
 		InitialInterval time.Duration
 		MaxInterval     time.Duration
 	}
+
+	// RateLimit throttles the client to RequestsPerSecond on average, allowing
+	// bursts of up to Burst requests, so that goroutines sharing it stay below
+	// the Stride API's rate limit. Requests wait for their turn until their
+	// context is done. Disabled if RequestsPerSecond is 0. Subscriptions aren't
+	// throttled.
+	RateLimit struct {
+		RequestsPerSecond float64
+		Burst             int
+	}
 }
 
 // defaultConfig is the default configuration
 var defaultConfig = &Config{
-	Timeout:  5 * time.Second,
-	Endpoint: Endpoint,
+	Timeout:          5 * time.Second,
+	Endpoint:         Endpoint,
+	ErrorLogInterval: 10 * time.Second,
+	Logger:           defaultLogger,
 	Subscription: struct {
+		InitialInterval     time.Duration
+		MaxInterval         time.Duration
+		MaxElapsedTime      time.Duration
+		RandomizationFactor float64
+		BufferSize          int
+		DropOldest          bool
+		MaxEventSize        int
+		ConnectTimeout      time.Duration
+		Resume              bool
+		Filter              func(event map[string]interface{}) bool
+		Coalesce            bool
+		CoalesceKeys        []string
+		OnLive              func()
+	}{
+		InitialInterval:     time.Second,
+		MaxInterval:         300 * time.Second,
+		RandomizationFactor: backoff.DefaultRandomizationFactor,
+		MaxEventSize:        1 << 20,
+		ConnectTimeout:      10 * time.Second,
+	},
+	Retry: struct {
+		MaxRetries      int
 		InitialInterval time.Duration
 		MaxInterval     time.Duration
 	}{
-		InitialInterval: time.Second,
-		MaxInterval:     300 * time.Second,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     5 * time.Second,
 	},
 }
 
@@ -130,9 +546,18 @@ func NewConfig() *Config {
 
 // Stride is a wrapper around the Stride API
 type Stride struct {
-	apiKey string
-	client *http.Client
-	config *Config
+	auth    *credentials
+	client  Doer
+	codec   Codec
+	config  *Config
+	limiter *rate.Limiter
+
+	compressionLogged sync.Once
+	errors            *errorLimiter
+
+	// Paths allowed by AllowPath on top of validPaths, by method
+	pathsMu sync.RWMutex
+	paths   map[string][]*regexp.Regexp
 }
 
 // Response is a wrapped response from the API
@@ -140,166 +565,943 @@ type Response struct {
 	StatusCode int
 	Data       interface{}
 	Error      error
+
+	// Raw is the unparsed response body, which is set even if it isn't valid
+	// JSON and Error is ErrInvalidResponse
+	Raw []byte
+
+	// Cause is the underlying error when the request failed before a response
+	// was received, e.g. a *url.Error wrapping a timeout or connection refused.
+	// If the request's context was done, Error is the context's error instead of
+	// ErrRequestFailed.
+	Cause error
+
+	// RateLimit is the API key's rate limit reported by the response, or nil if
+	// the response didn't report one
+	RateLimit *RateLimit
+}
+
+// IsTransportError returns whether the request failed before a response was
+// received, e.g. because the Stride API could not be reached, the request timed
+// out or its context was done, as opposed to the API rejecting the request
+func (r *Response) IsTransportError() bool {
+	return r.Cause != nil
 }
 
-// NewStride returns a new Stride API client
+// NewStride returns a new Stride API client. It panics if the config's Endpoint
+// isn't an absolute http or https URL.
 func NewStride(apiKey string, config *Config) *Stride {
+	if err := validateEndpoint(config.Endpoint); err != nil {
+		panic(fmt.Sprintf("stride: invalid Endpoint %q: %s", config.Endpoint, err))
+	}
+
+	var client Doer = &http.Client{
+		Timeout:   config.Timeout,
+		Transport: newTransport(config.RootCAs),
+	}
+	if config.Client != nil {
+		client = config.Client
+	}
+
 	return &Stride{
-		apiKey: apiKey,
-		client: &http.Client{
-			Timeout: config.Timeout,
-		},
-		config: config,
+		auth:    newCredentials(config.Auth, apiKey),
+		client:  client,
+		codec:   orStdCodec(config.Codec),
+		config:  config,
+		limiter: newLimiter(config),
+		errors:  newErrorLimiter(config.ErrorLogInterval),
 	}
 }
 
-func compressBody(body []byte) ([]byte, error) {
+// newLimiter returns the limiter throttling a client per its RateLimit config,
+// or nil if it isn't throttled
+func newLimiter(config *Config) *rate.Limiter {
+	if config.RateLimit.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	burst := config.RateLimit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(config.RateLimit.RequestsPerSecond), burst)
+}
+
+// validateEndpoint checks that endpoint is an absolute http or https URL, with
+// an optional base path
+func validateEndpoint(endpoint string) error {
+	u, err := neturl.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an absolute http or https URL")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not have a query or fragment")
+	}
+	return nil
+}
+
+// userAgent returns the User-Agent of requests, which identifies the client
+// library and version, followed by the app's own product tokens if any
+func userAgent(app string) string {
+	ua := fmt.Sprintf("gostride (version: %s)", Version)
+	if app != "" {
+		ua += " " + app
+	}
+	return ua
+}
+
+// joinURL appends path to endpoint, which may have a trailing slash
+func joinURL(endpoint, path string) string {
+	return strings.TrimRight(endpoint, "/") + path
+}
+
+// newTransport returns a transport verifying TLS certificates against rootCAs,
+// or nil to use the default transport
+func newTransport(rootCAs *x509.CertPool) http.RoundTripper {
+	return newConnectTransport(rootCAs, 0)
+}
+
+// newConnectTransport returns a transport whose dials and TLS handshakes are
+// bounded by connectTimeout, if it's non-zero, or nil to use the default
+// transport if there's nothing to customize. It's otherwise configured like the
+// default transport, so it keeps HTTP/2 and its idle connection limits.
+func newConnectTransport(rootCAs *x509.CertPool, connectTimeout time.Duration) http.RoundTripper {
+	if rootCAs == nil && connectTimeout == 0 {
+		return nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if rootCAs != nil {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.RootCAs = rootCAs
+	}
+	if connectTimeout > 0 {
+		t.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		t.TLSHandshakeTimeout = connectTimeout
+	}
+	return t
+}
+
+// compressionLevel is the gzip level request bodies are compressed with
+const compressionLevel = gzip.DefaultCompression
+
+// maxPooledBufferSize is the capacity above which a compression buffer isn't
+// returned to its pool, so that one large batch doesn't pin its memory
+const maxPooledBufferSize = 1 << 20
+
+// Writers and buffers reused by compressBody, since each gzip.Writer allocates
+// hundreds of KB of compressor state
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(ioutil.Discard, compressionLevel)
+		return gz
+	}}
+	compressBuffers = sync.Pool{New: func() interface{} {
+		return new(bytes.Buffer)
+	}}
+)
+
+// encodeJSON encodes data as JSON with the codec, also writing it to tee if
+// it's non-nil
+func encodeJSON(codec Codec, data interface{}, tee io.Writer) ([]byte, error) {
 	var bb bytes.Buffer
-	gz := gzip.NewWriter(&bb)
-	if _, err := gz.Write(body); err != nil {
+	var w io.Writer = &bb
+	if tee != nil {
+		w = io.MultiWriter(&bb, tee)
+	}
+	if err := writeJSON(codec, w, data); err != nil {
 		return nil, err
 	}
-	if err := gz.Flush(); err != nil {
+	return bb.Bytes(), nil
+}
+
+// compressJSON is compressBody for an Encoder, whose body outlives the call, so
+// it's copied out of the pooled buffer
+func compressJSON(codec Codec, data interface{}, tee io.Writer) ([]byte, error) {
+	body, err := compressBody(codec, data, tee)
+	if err != nil {
+		return nil, err
+	}
+	defer body.release()
+	return append([]byte(nil), body.bytes()...), nil
+}
+
+// compressBody encodes data as gzip compressed JSON with the codec into an
+// in-memory buffer, so that the body's size is known before it's sent, unlike
+// a streamedBody's. If tee is non-nil the uncompressed JSON is also
+// written to it. The gzip writer and buffer are pooled across calls, and the
+// buffer is only reused once the body is released.
+func compressBody(codec Codec, data interface{}, tee io.Writer) (*pooledBody, error) {
+	body := &pooledBody{buf: compressBuffers.Get().(*bytes.Buffer)}
+	body.buf.Reset()
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(body.buf)
+	defer func() {
+		// Drop the writer's reference to the buffer, along with any state left
+		// by a failed encoding
+		gz.Reset(ioutil.Discard)
+		gzipWriters.Put(gz)
+	}()
+
+	var w io.Writer = gz
+	if tee != nil {
+		w = io.MultiWriter(gz, tee)
+	}
+	if err := writeJSON(codec, w, data); err != nil {
+		body.release()
 		return nil, err
 	}
 	if err := gz.Close(); err != nil {
+		body.release()
 		return nil, err
 	}
-	return bb.Bytes(), nil
+	return body, nil
+}
+
+// errBodyReleased is returned by reads of a pooledBody after its release
+var errBodyReleased = errors.New("request body was released")
+
+// pooledBody is a request body in a buffer from compressBuffers. Its readers
+// fail once it's released back to the pool, so that a transport still writing
+// a request it gave up on can't read the buffer after it's reused.
+type pooledBody struct {
+	mu  sync.Mutex
+	buf *bytes.Buffer
+}
+
+// bytes returns the body, which is only valid until it's released
+func (p *pooledBody) bytes() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.buf == nil {
+		return nil
+	}
+	return p.buf.Bytes()
+}
+
+// reader returns a new reader of the body, e.g. for http.Request.GetBody
+func (p *pooledBody) reader() io.ReadCloser {
+	return &pooledBodyReader{body: p}
+}
+
+// release returns the buffer to the pool, unless it grew too large to keep
+func (p *pooledBody) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.buf != nil && p.buf.Cap() <= maxPooledBufferSize {
+		compressBuffers.Put(p.buf)
+	}
+	p.buf = nil
+}
+
+type pooledBodyReader struct {
+	body *pooledBody
+	off  int
+}
+
+func (r *pooledBodyReader) Read(b []byte) (int, error) {
+	r.body.mu.Lock()
+	defer r.body.mu.Unlock()
+	if r.body.buf == nil {
+		return 0, errBodyReleased
+	}
+	data := r.body.buf.Bytes()
+	if r.off >= len(data) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// Close leaves the buffer to the body's release, since the transport may close
+// a reader before asking GetBody for another one
+func (r *pooledBodyReader) Close() error {
+	return nil
+}
+
+// streamedBody is a request body of events keyed by stream that's encoded as
+// gzip compressed JSON while it's sent, so that neither the whole JSON nor the
+// whole compressed body is held in memory. Each reader encodes the events
+// again, e.g. for a retry.
+type streamedBody struct {
+	codec  Codec
+	events map[string][]map[string]interface{}
+
+	// Compressed bytes of the latest reader taken in by the transport
+	sent int64
+
+	mu  sync.Mutex
+	err error
+}
+
+func newStreamedBody(codec Codec, events map[string][]map[string]interface{}) *streamedBody {
+	return &streamedBody{codec: codec, events: events}
+}
+
+// reader returns a new reader of the body, which encodes the events through a
+// pipe as it's read. Closing the reader stops the encoding.
+func (s *streamedBody) reader() io.ReadCloser {
+	atomic.StoreInt64(&s.sent, 0)
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(&streamedBodyWriter{body: s, w: pw})
+		err := writeEvents(s.codec, gz, s.events)
+		if err == nil {
+			err = gz.Close()
+		}
+		gz.Reset(ioutil.Discard)
+		gzipWriters.Put(gz)
+
+		// Failing to write to a pipe the transport closed isn't the body's fault
+		if err != nil && err != io.ErrClosedPipe {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
 }
 
-func (s *Stride) makeRequest(method, path string, data interface{}) *Response {
-	if !isPathValid(method, path) {
-		return &Response{
-			-1,
-			nil,
-			ErrInvalidPath,
+// writeEvents writes events keyed by stream as a JSON object with the codec,
+// like writeJSON, but encodes one event at a time
+func writeEvents(codec Codec, w io.Writer, events map[string][]map[string]interface{}) error {
+	streams := make([]string, 0, len(events))
+	for stream := range events {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	if _, err := io.WriteString(w, "{"); err != nil {
+		return err
+	}
+	for i, stream := range streams {
+		key, err := json.Marshal(stream)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			key = append([]byte{','}, key...)
+		}
+		if _, err := w.Write(append(key, ':', '[')); err != nil {
+			return err
+		}
+
+		for j, event := range events[stream] {
+			b, err := codec.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if j > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "]"); err != nil {
+			return err
 		}
 	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// encodeErr returns the error encoding the body, if any reader failed to
+func (s *streamedBody) encodeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// bytesSent returns the compressed bytes the latest reader was read for
+func (s *streamedBody) bytesSent() int {
+	return int(atomic.LoadInt64(&s.sent))
+}
+
+// streamedBodyWriter counts the compressed bytes written to a streamedBody's
+// pipe, which only returns once the transport read them
+type streamedBodyWriter struct {
+	body *streamedBody
+	w    io.Writer
+}
+
+func (w *streamedBodyWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	atomic.AddInt64(&w.body.sent, int64(n))
+	return n, err
+}
+
+// acceptEncoding is the Accept-Encoding of requests, which decompress handles.
+// Setting it also stops http.Transport from transparently decompressing
+// responses, so that BytesReceived counts the bytes on the wire.
+const acceptEncoding = "gzip, deflate"
+
+// decompress decodes a response body per its Content-Encoding. A "deflate" body
+// should be zlib-wrapped, but raw deflate is accepted too since some servers
+// send that instead.
+func decompress(body []byte, encoding string) ([]byte, error) {
+	if len(body) == 0 {
+		return body, nil
+	}
+
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, err
+		}
+		r = gz
+	case "deflate":
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return body, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return body, err
+	}
+	return decoded, nil
+}
+
+// logCompression logs the outcome of the first compressed request sent by a
+// client, and warns through limiter whenever a compressed request body is
+// rejected since that usually means the server didn't decompress it
+func logCompression(lg *entry, once *sync.Once, limiter *errorLimiter, encoding string, statusCode int) {
+	if encoding == "" {
+		return
+	}
+
+	lg = lg.WithFields(Fields{
+		"content_encoding":  encoding,
+		"compression_level": compressionLevel,
+		"status_code":       statusCode,
+	})
+
+	once.Do(func() {
+		lg.WithField("accepted", statusCode != http.StatusBadRequest).Debug("Sent compressed request body")
+	})
+
+	if statusCode == http.StatusBadRequest {
+		limiter.warn(lg, "Stride API rejected compressed request body, check that it supports the Content-Encoding")
+	}
+}
+
+// bodyEncoder encodes a request body like an Encoder, also writing the JSON it
+// encoded, before any compression, to tee if it's non-nil
+type bodyEncoder func(data interface{}, tee io.Writer) ([]byte, string, error)
 
-	lg := log.WithFields(logrus.Fields{
+func (s *Stride) encoderFor(path string) bodyEncoder {
+	for _, rule := range s.config.Encoders {
+		if rule.Pattern.MatchString(path) {
+			encode := rule.Encoder
+			return func(data interface{}, tee io.Writer) ([]byte, string, error) {
+				b, encoding, err := encode(data)
+				if err == nil && tee != nil {
+					// The JSON is only known from the body the encoder returned
+					if payload, err := decompress(b, encoding); err == nil {
+						tee.Write(payload)
+					}
+				}
+				return b, encoding, err
+			}
+		}
+	}
+	if collectPath.MatchString(path) {
+		// Compress events written to /collect
+		return func(data interface{}, tee io.Writer) ([]byte, string, error) {
+			b, err := compressJSON(s.codec, data, tee)
+			return b, "gzip", err
+		}
+	}
+	return func(data interface{}, tee io.Writer) ([]byte, string, error) {
+		b, err := s.codec.Marshal(data)
+		if err == nil && tee != nil {
+			tee.Write(b)
+		}
+		return b, "", err
+	}
+}
+
+// RequestOption customizes a single request
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	header  http.Header
+	timeout time.Duration
+	query   neturl.Values
+}
+
+// isTimeout returns whether err is a timeout, e.g. of the config's Timeout
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// WithTimeout bounds the request by d instead of the config's Timeout, e.g. to
+// allow a slow analyze query more time. The request fails with ErrTimeout if it
+// doesn't complete in time.
+func WithTimeout(d time.Duration) RequestOption {
+	return func(o *requestOptions) {
+		o.timeout = d
+	}
+}
+
+// WithHeader adds a header to the request, e.g. a request ID for correlating it
+// with the Stride API's logs. It can't override the headers the client sets
+// itself, such as Authorization and Content-Type.
+func WithHeader(key, value string) RequestOption {
+	return func(o *requestOptions) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Add(key, value)
+	}
+}
+
+// WithIdempotencyKey sets the IdempotencyKeyHeader of the request, so that the
+// Stride API applies it only once however many times it's sent. It's honored
+// by POST /collect and by the POST and PUT /process endpoints. POST requests
+// with a key are retried like PUT requests.
+func WithIdempotencyKey(key string) RequestOption {
+	return func(o *requestOptions) {
+		if o.header == nil {
+			o.header = make(http.Header)
+		}
+		o.header.Set(IdempotencyKeyHeader, key)
+	}
+}
+
+// withQuery adds a query parameter to the request's URL
+func withQuery(key, value string) RequestOption {
+	return func(o *requestOptions) {
+		if o.query == nil {
+			o.query = make(neturl.Values)
+		}
+		o.query.Add(key, value)
+	}
+}
+
+// newIdempotencyKey returns a random (version 4) UUID
+func newIdempotencyKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (s *Stride) makeRequest(ctx context.Context, method, path string, data interface{}, opts ...RequestOption) *Response {
+	if !s.isPathValid(method, path) {
+		return &Response{StatusCode: -1, Error: ErrInvalidPath}
+	}
+	return s.makeRawRequest(ctx, method, path, data, opts...)
+}
+
+// makeRawRequest issues a request without validating its path
+func (s *Stride) makeRawRequest(ctx context.Context, method, path string, data interface{}, opts ...RequestOption) (r *Response) {
+	if s.config.Tracer != nil {
+		var finish func(int, error)
+		ctx, finish = s.config.Tracer.StartSpan(ctx, method+" "+path)
+		defer func() {
+			finish(r.StatusCode, r.Error)
+		}()
+	}
+
+	lg := newEntry(s.config.Logger, Fields{
 		"endpoint": s.config.Endpoint,
 		"module":   "stride",
 		"method":   method,
 		"function": "makeRequest",
 	})
+	if s.config.LogFieldsFromContext != nil {
+		lg = lg.WithFields(Fields(s.config.LogFieldsFromContext(ctx)))
+	}
 
-	url := s.config.Endpoint + path
-	var reader io.Reader
+	var options requestOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	parent := ctx
+	if options.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.timeout)
+		defer cancel()
+	}
+
+	url := joinURL(s.config.Endpoint, path)
+	if len(options.query) > 0 {
+		url += "?" + options.query.Encode()
+	}
+	// A dry run logs the uncompressed payload as it's encoded
+	var payload *bytes.Buffer
+	var tee io.Writer
+	if s.config.DryRun {
+		payload = &bytes.Buffer{}
+		tee = payload
+	}
 	var body []byte
-	var compressed bool
+	var contentEncoding string
 	if data != nil {
-		b, err := json.Marshal(data)
+		b, enc, err := s.encoderFor(path)(data, tee)
 		if err != nil {
-			lg.WithError(err).Error("Failed to JSONify request body")
-			return &Response{
-				-1,
-				nil,
-				ErrInvalidBody,
-			}
-		}
-		// Compress events written to /collect
-		if collectPath.Match([]byte(path)) {
-			b, err = compressBody(b)
-			if err != nil {
-				lg.WithError(err).Error("Failed to compress request body")
-				return &Response{
-					-1,
-					nil,
-					err,
-				}
-			}
-			compressed = true
+			err := newBodyError(data, err)
+			lg.WithError(err).Error("Failed to encode request body")
+			return &Response{StatusCode: -1, Error: err}
 		}
 		body = b
-		reader = bytes.NewReader(b)
+		contentEncoding = enc
 	}
 
-	req, _ := http.NewRequest(method, url, reader)
-	if compressed {
-		req.Header.Add("Content-Encoding", "gzip")
+	if s.config.DryRun {
+		fields := Fields{"path": path}
+		if data != nil {
+			fields["payload"] = string(bytes.TrimRight(payload.Bytes(), "\n"))
+		}
+		lg.WithFields(fields).Debug("Dry run, not sending request")
+		return &Response{StatusCode: http.StatusOK}
 	}
-	req.Header.Add("User-Agent", fmt.Sprintf("gostride (version: %s)", Version))
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	if body != nil {
-		req.Header.Add("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	metrics := &RequestMetrics{
+		Method:     method,
+		Path:       path,
+		StatusCode: -1,
+		BytesSent:  len(body),
+
+		ContentEncoding: contentEncoding,
+	}
+	if s.config.Observer != nil {
+		defer s.config.Observer(metrics)
+	}
+
+	if s.limiter != nil {
+		if err := s.limiter.Wait(ctx); err != nil {
+			if parent.Err() != nil {
+				return &Response{StatusCode: -1, Error: parent.Err(), Cause: err}
+			}
+			// The request's deadline would pass before its turn
+			return &Response{StatusCode: -1, Error: ErrTimeout, Cause: err}
+		}
 	}
-	req.SetBasicAuth(s.apiKey, "")
 
-	res, err := s.client.Do(req)
+	res, err := s.do(ctx, method, url, body, contentEncoding, &options, metrics)
 	if err != nil {
-		lg.WithError(err).Error("Request to Stride API failed")
-		return &Response{
-			-1,
-			nil,
-			ErrRequestFailed,
+		// The caller gave up on the request, so there's nothing to log
+		if parent.Err() != nil {
+			return &Response{StatusCode: -1, Error: parent.Err(), Cause: err}
 		}
+		if ctx.Err() != nil || isTimeout(err) {
+			s.errors.error(lg.WithError(err), "Request to Stride API timed out")
+			return &Response{StatusCode: -1, Error: ErrTimeout, Cause: err}
+		}
+		s.errors.error(lg.WithError(err), "Request to Stride API failed")
+		return &Response{StatusCode: -1, Error: ErrRequestFailed, Cause: err}
 	}
 	defer res.Body.Close()
 
+	metrics.StatusCode = res.StatusCode
+	metrics.RateLimit = parseRateLimit(res.Header)
+	logCompression(lg, &s.compressionLogged, s.errors, contentEncoding, res.StatusCode)
+
 	var v interface{}
+	var raw []byte
 
 	if res.Body != nil {
-		body, err = ioutil.ReadAll(res.Body)
-		if err == nil && len(body) > 0 {
-			err = json.Unmarshal(body, &v)
+		raw, err = ioutil.ReadAll(res.Body)
+		metrics.BytesReceived = len(raw)
+		if err == nil {
+			raw, err = decompress(raw, res.Header.Get("Content-Encoding"))
+		}
+		if err == nil && len(raw) > 0 {
+			err = s.codec.Unmarshal(raw, &v)
 		}
 
 		if err != nil {
-			lg.WithError(err).Error("Failed to read/parse response body")
+			s.errors.error(lg.WithError(err), "Failed to read/parse response body")
 
-			return &Response{
-				res.StatusCode,
-				nil,
-				ErrInvalidResponse,
-			}
+			return &Response{StatusCode: res.StatusCode, Raw: raw, Error: ErrInvalidResponse, RateLimit: metrics.RateLimit}
 		}
 	}
 
 	if res.StatusCode < 200 || res.StatusCode > 201 {
-		lg.WithField("status_code", res.StatusCode).Error("Stride API returned invalid status code")
+		s.errors.error(lg.WithField("status_code", res.StatusCode), "Stride API returned invalid status code")
+
+		return &Response{StatusCode: res.StatusCode, Data: v, Raw: raw, Error: newAPIError(res.StatusCode, v, raw), RateLimit: metrics.RateLimit}
+	}
 
-		return &Response{
-			res.StatusCode,
-			v,
-			errorFromStatusCode(res.StatusCode),
+	return &Response{StatusCode: res.StatusCode, Data: v, Raw: raw, RateLimit: metrics.RateLimit}
+}
+
+// do issues a request, re-issuing it per the Retry config while it fails
+// transiently. The body is buffered so that it can be replayed on each attempt.
+// The last response or error is returned once retries are exhausted.
+func (s *Stride) do(ctx context.Context, method, url string, body []byte, contentEncoding string, options *requestOptions, metrics *RequestMetrics) (*http.Response, error) {
+	// A per-request timeout replaces the client's, which is enforced on top of
+	// the context's deadline
+	client := s.client
+	if hc, ok := s.client.(*http.Client); ok && options.timeout > 0 {
+		c := *hc
+		c.Timeout = 0
+		client = &c
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = s.config.Retry.InitialInterval
+	b.MaxInterval = s.config.Retry.MaxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	for {
+		res, err := client.Do(s.newRequest(ctx, method, url, body, contentEncoding, options.header))
+		if metrics.Retries >= s.config.Retry.MaxRetries || ctx.Err() != nil || !isRetryable(method, options.header.Get(IdempotencyKeyHeader) != "", res, err) {
+			return res, err
+		}
+
+		// A 429's Retry-After takes precedence over the backoff
+		wait := b.NextBackOff()
+		if res != nil && res.StatusCode == http.StatusTooManyRequests {
+			if d, ok := parseRetryAfter(res.Header, time.Now()); ok {
+				wait = d
+				if max := s.config.Retry.MaxInterval; max > 0 && wait > max {
+					wait = max
+				}
+			}
 		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return res, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return res, err
+		}
+
+		if res != nil {
+			res.Body.Close()
+		}
+		metrics.Retries++
 	}
+}
 
-	return &Response{
-		res.StatusCode,
-		v,
-		nil,
+func (s *Stride) newRequest(ctx context.Context, method, url string, body []byte, contentEncoding string, header http.Header) *http.Request {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, _ := http.NewRequest(method, url, reader)
+	req = req.WithContext(ctx)
+	// The caller's headers can't override the client's own
+	for k, vs := range header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
 	}
+	req.Header.Set("User-Agent", userAgent(s.config.UserAgent))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	req.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	}
+	s.auth.Apply(req)
+	if s.config.Tracer != nil {
+		s.config.Tracer.Inject(ctx, req.Header)
+	}
+
+	return req
+}
+
+// isRetryable returns whether a request that failed with the given response
+// or error can safely be re-issued
+func isRetryable(method string, idempotent bool, res *http.Response, err error) bool {
+	unsafe := (method == http.MethodPost || method == http.MethodPatch) && !idempotent
+	if err != nil {
+		// A POST or PATCH may have been applied even if its response was lost,
+		// unless it was never sent in the first place
+		return !unsafe || isDialError(err)
+	}
+	if unsafe {
+		return false
+	}
+
+	switch res.StatusCode {
+	case 429, 503, 504:
+		return true
+	}
+	return false
+}
+
+// isDialError returns whether err occurred establishing a connection, before
+// any of the request was sent
+func isDialError(err error) bool {
+	if uerr, ok := err.(*neturl.Error); ok {
+		err = uerr.Err
+	}
+	operr, ok := err.(*net.OpError)
+	return ok && operr.Op == "dial"
 }
 
 // Get makes a GET request to the path
-func (s *Stride) Get(path string) *Response {
-	return s.makeRequest(http.MethodGet, path, nil)
+func (s *Stride) Get(path string, opts ...RequestOption) *Response {
+	return s.GetContext(context.Background(), path, opts...)
+}
+
+// GetContext makes a GET request to the path, bound by ctx
+func (s *Stride) GetContext(ctx context.Context, path string, opts ...RequestOption) *Response {
+	return s.makeRequest(ctx, http.MethodGet, path, nil, opts...)
+}
+
+// GetInto makes a GET request to the path and decodes the response body into
+// v, which must be a pointer. v is left untouched if the request fails.
+func (s *Stride) GetInto(path string, v interface{}, opts ...RequestOption) error {
+	return s.GetIntoContext(context.Background(), path, v, opts...)
+}
+
+// GetIntoContext makes a GET request to the path, bound by ctx, and decodes the
+// response body into v
+func (s *Stride) GetIntoContext(ctx context.Context, path string, v interface{}, opts ...RequestOption) error {
+	r := s.GetContext(ctx, path, opts...)
+	if r.Error != nil {
+		return r.Error
+	}
+	if len(r.Raw) == 0 {
+		return nil
+	}
+	return s.codec.Unmarshal(r.Raw, v)
 }
 
 // Post makes a POST request to the path
-func (s *Stride) Post(path string, data interface{}) *Response {
-	return s.makeRequest(http.MethodPost, path, data)
+func (s *Stride) Post(path string, data interface{}, opts ...RequestOption) *Response {
+	return s.PostContext(context.Background(), path, data, opts...)
+}
+
+// PostContext makes a POST request to the path, bound by ctx
+func (s *Stride) PostContext(ctx context.Context, path string, data interface{}, opts ...RequestOption) *Response {
+	return s.makeRequest(ctx, http.MethodPost, path, data, opts...)
+}
+
+// CollectSync writes events, keyed by stream, to /collect in a single request
+func (s *Stride) CollectSync(events map[string][]map[string]interface{}, opts ...RequestOption) *Response {
+	return s.CollectSyncContext(context.Background(), events, opts...)
+}
+
+// CollectSyncContext writes events, keyed by stream, to /collect in a single
+// request, bound by ctx
+func (s *Stride) CollectSyncContext(ctx context.Context, events map[string][]map[string]interface{}, opts ...RequestOption) *Response {
+	return s.makeRequest(ctx, http.MethodPost, "/collect", events, opts...)
 }
 
 // Put makes a PUT request to the path
-func (s *Stride) Put(path string, data interface{}) *Response {
-	return s.makeRequest(http.MethodPut, path, data)
+func (s *Stride) Put(path string, data interface{}, opts ...RequestOption) *Response {
+	return s.PutContext(context.Background(), path, data, opts...)
+}
+
+// PutContext makes a PUT request to the path, bound by ctx
+func (s *Stride) PutContext(ctx context.Context, path string, data interface{}, opts ...RequestOption) *Response {
+	return s.makeRequest(ctx, http.MethodPut, path, data, opts...)
+}
+
+// Patch makes a PATCH request to the path, partially updating a process or
+// analysis with data
+func (s *Stride) Patch(path string, data interface{}, opts ...RequestOption) *Response {
+	return s.PatchContext(context.Background(), path, data, opts...)
+}
+
+// PatchContext makes a PATCH request to the path, bound by ctx
+func (s *Stride) PatchContext(ctx context.Context, path string, data interface{}, opts ...RequestOption) *Response {
+	return s.makeRequest(ctx, http.MethodPatch, path, data, opts...)
+}
+
+// Raw makes a request with any method to any path, e.g. to try out an endpoint
+// this version of the client doesn't know of. Unlike the other methods, the
+// path is NOT validated, so a malformed path is sent as is rather than failing
+// with ErrInvalidPath. The request is otherwise made like any other, with its
+// body encoded per the Encoders, and errors mapped the same way. Data may be
+// nil for a request without a body.
+func (s *Stride) Raw(method, path string, data interface{}, opts ...RequestOption) *Response {
+	return s.RawContext(context.Background(), method, path, data, opts...)
+}
+
+// RawContext makes an unvalidated request like Raw, bound by ctx
+func (s *Stride) RawContext(ctx context.Context, method, path string, data interface{}, opts ...RequestOption) *Response {
+	return s.makeRawRequest(ctx, method, path, data, opts...)
 }
 
 // Delete makes a DELETE request to the path
-func (s *Stride) Delete(path string) *Response {
-	return s.makeRequest(http.MethodDelete, path, nil)
+func (s *Stride) Delete(path string, opts ...RequestOption) *Response {
+	return s.DeleteContext(context.Background(), path, opts...)
+}
+
+// DeleteContext makes a DELETE request to the path, bound by ctx
+func (s *Stride) DeleteContext(ctx context.Context, path string, opts ...RequestOption) *Response {
+	return s.makeRequest(ctx, http.MethodDelete, path, nil, opts...)
+}
+
+// DeleteIfExists makes a DELETE request to the path, treating a 404 as success
+// so that deleting something that's already gone isn't an error
+func (s *Stride) DeleteIfExists(path string, opts ...RequestOption) *Response {
+	return s.DeleteIfExistsContext(context.Background(), path, opts...)
+}
+
+// DeleteIfExistsContext makes a DELETE request to the path, bound by ctx,
+// treating a 404 as success
+func (s *Stride) DeleteIfExistsContext(ctx context.Context, path string, opts ...RequestOption) *Response {
+	r := s.DeleteContext(ctx, path, opts...)
+	if r.StatusCode == http.StatusNotFound {
+		r.Error = nil
+	}
+	return r
+}
+
+// Ping checks that the endpoint is reachable and accepts the API key with a GET
+// of /collect. It returns nil for any 2xx response, an error matching
+// ErrInvalidAPIKey if the key was rejected, ErrRequestFailed if the endpoint
+// couldn't be reached, ErrTimeout if it didn't respond within the config's
+// Timeout, or the context's error if ctx is done first.
+func (s *Stride) Ping(ctx context.Context) error {
+	r := s.GetContext(ctx, "/collect")
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+	return r.Error
+}
+
+// SetAPIKey replaces the API key that requests are authenticated with from now
+// on, e.g. to rotate it without restarting. It's safe to call concurrently with
+// requests. Subscriptions keep the key they were created with, so set theirs
+// too. The key is unused if the config's Auth is set.
+func (s *Stride) SetAPIKey(apiKey string) {
+	s.auth.setKey(apiKey)
 }
 
 // Subscribe makes a GET request to a subscribe endpoint
 func (s *Stride) Subscribe(path string) (*Subscription, error) {
-	if !isPathValid("Subscribe", path) {
+	if !s.isPathValid("Subscribe", path) {
 		return nil, ErrInvalidPath
 	}
 
-	sub := newSubscription(s.apiKey, path, s.config)
+	sub := newSubscription(s.auth.key(), path, s.config)
 	return sub, nil
 }
@@ -1,11 +1,28 @@
 package stride
 
 import (
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -38,6 +55,10 @@ func createMockServer(t *testing.T) *httptest.Server {
 			assert.NotNil(t, r.Body)
 			body, _ := ioutil.ReadAll(r.Body)
 			w.Write(body)
+		case http.MethodPatch:
+			w.WriteHeader(http.StatusOK)
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
 		case http.MethodDelete:
 			w.WriteHeader(http.StatusOK)
 		}
@@ -64,6 +85,255 @@ func (suite *StrideTestSuite) TestCollectCompression() {
 	assert.Equal(suite.T(), len(events), len(r.Data.([]interface{})))
 }
 
+func (suite *StrideTestSuite) TestEncoders() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Encoders = append([]EncoderRule{
+		{regexp.MustCompile(`^/process`), GzipJSONEncoder},
+	}, config.Encoders...)
+
+	s := NewStride("key", config)
+	proc := map[string]interface{}{"query": "SELECT 1"}
+
+	// Compressed by our rule, the mock server echoes back the decompressed body
+	r := s.Post("/process/p1", proc)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), proc, r.Data)
+
+	config.Encoders = []EncoderRule{
+		{regexp.MustCompile(`^/analyze`), func(data interface{}) ([]byte, string, error) {
+			return nil, "", errors.New("nope")
+		}},
+	}
+	r = s.Post("/analyze/q1", proc)
+	assert.True(suite.T(), errors.Is(r.Error, ErrInvalidBody))
+	assert.Equal(suite.T(), "nope", errors.Unwrap(r.Error).Error())
+
+	r = s.Post("/process/p1", proc)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), proc, r.Data)
+}
+
+func (suite *StrideTestSuite) TestBodyError() {
+	s := NewStride("key", NewConfig())
+
+	r := s.Post("/collect/s0", []map[string]interface{}{
+		{"x": "x"},
+		{"x": "x", "tags": []interface{}{"a", make(chan int)}},
+	})
+	assert.True(suite.T(), errors.Is(r.Error, ErrInvalidBody))
+	var bodyErr *BodyError
+	assert.True(suite.T(), errors.As(r.Error, &bodyErr))
+	assert.Equal(suite.T(), "[1].tags[1]", bodyErr.Path)
+	var typeErr *json.UnsupportedTypeError
+	assert.True(suite.T(), errors.As(r.Error, &typeErr))
+	assert.Equal(suite.T(), "Invalid request body at [1].tags[1]: json: unsupported type: chan int", r.Error.Error())
+
+	r = s.Post("/process/p1", map[string]interface{}{"query": math.Inf(1)})
+	assert.True(suite.T(), errors.As(r.Error, &bodyErr))
+	assert.Equal(suite.T(), "query", bodyErr.Path)
+}
+
+func (suite *StrideTestSuite) TestCompressJSON() {
+	events := []map[string]interface{}{{"x": "x"}, {"y": "y"}}
+	b, err := compressJSON(StdCodec{}, events, nil)
+	assert.Nil(suite.T(), err)
+
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	assert.Nil(suite.T(), err)
+	var decoded []map[string]interface{}
+	assert.Nil(suite.T(), json.NewDecoder(gz).Decode(&decoded))
+	assert.Equal(suite.T(), events, decoded)
+
+	_, err = compressJSON(StdCodec{}, map[string]interface{}{"f": func() {}}, nil)
+	assert.NotNil(suite.T(), err)
+
+	// Nothing leaks between bodies through the pooled writers and buffers,
+	// including from a larger body or one that failed to encode
+	large := make([]map[string]interface{}, 1000)
+	for i := range large {
+		large[i] = map[string]interface{}{"n": i}
+	}
+	lb, err := compressJSON(StdCodec{}, large, nil)
+	assert.Nil(suite.T(), err)
+	for i := 0; i < 10; i++ {
+		compressJSON(StdCodec{}, []interface{}{"x", make(chan int)}, nil)
+		b2, err := compressJSON(StdCodec{}, events, nil)
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), b, b2)
+	}
+
+	gz, err = gzip.NewReader(bytes.NewReader(lb))
+	assert.Nil(suite.T(), err)
+	var decodedLarge []map[string]interface{}
+	assert.Nil(suite.T(), json.NewDecoder(gz).Decode(&decodedLarge))
+	assert.Equal(suite.T(), len(large), len(decodedLarge))
+	assert.Equal(suite.T(), float64(999), decodedLarge[999]["n"])
+}
+
+func (suite *StrideTestSuite) TestPooledBody() {
+	events := []map[string]interface{}{{"x": "x"}}
+	expected, err := compressJSON(StdCodec{}, events, nil)
+	assert.Nil(suite.T(), err)
+
+	body, err := compressBody(StdCodec{}, events, nil)
+	assert.Nil(suite.T(), err)
+	b, err := ioutil.ReadAll(body.reader())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), expected, b)
+
+	// Readers share the buffer, which they can't read once it's released
+	r := body.reader()
+	p := make([]byte, 1)
+	_, err = r.Read(p)
+	assert.Nil(suite.T(), err)
+	body.release()
+	_, err = r.Read(p)
+	assert.Equal(suite.T(), errBodyReleased, err)
+	assert.Nil(suite.T(), body.bytes())
+	body.release()
+}
+
+func (suite *StrideTestSuite) TestStreamedBody() {
+	events := map[string][]map[string]interface{}{
+		"s0": {{"x": "x"}, {"y": "<y>"}},
+		"s1": {{"z": 1}},
+	}
+	expected, err := encodeJSON(StdCodec{}, events, nil)
+	assert.Nil(suite.T(), err)
+
+	// Each reader encodes the events again, the same as writeJSON would
+	body := newStreamedBody(StdCodec{}, events)
+	for i := 0; i < 2; i++ {
+		compressed, err := ioutil.ReadAll(body.reader())
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), len(compressed), body.bytesSent())
+
+		gz, err := gzip.NewReader(bytes.NewReader(compressed))
+		assert.Nil(suite.T(), err)
+		b, err := ioutil.ReadAll(gz)
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), string(expected), string(b))
+	}
+	assert.Nil(suite.T(), body.encodeErr())
+
+	// Closing a reader stops the encoding without failing it
+	r := body.reader()
+	r.Read(make([]byte, 1))
+	r.Close()
+	assert.Nil(suite.T(), body.encodeErr())
+
+	body = newStreamedBody(StdCodec{}, map[string][]map[string]interface{}{"s0": {{"f": func() {}}}})
+	_, err = ioutil.ReadAll(body.reader())
+	assert.NotNil(suite.T(), err)
+	assert.Equal(suite.T(), err, body.encodeErr())
+}
+
+func (suite *StrideTestSuite) TestResponseEncoding() {
+	body := `[{"name": "Sarah Lynn"}]`
+	var gzipped, zlibbed, deflated bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(body))
+	gz.Close()
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write([]byte(body))
+	zw.Close()
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write([]byte(body))
+	fw.Close()
+
+	encodings := map[string][]byte{
+		"gzip":        gzipped.Bytes(),
+		"deflate":     zlibbed.Bytes(),
+		"raw-deflate": deflated.Bytes(),
+		"broken-gzip": []byte(body),
+		"unsupported": []byte(body),
+		"":            []byte(body),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(suite.T(), "gzip, deflate", r.Header.Get("Accept-Encoding"))
+		encoding := r.URL.Query().Get("encoding")
+		switch encoding {
+		case "raw-deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+		case "broken-gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+		case "unsupported":
+			w.Header().Set("Content-Encoding", "br")
+		default:
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Write(encodings[encoding])
+	}))
+	defer server.Close()
+
+	var metrics *RequestMetrics
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Observer = func(m *RequestMetrics) {
+		metrics = m
+	}
+	s := NewStride("key", config)
+
+	expected := []interface{}{map[string]interface{}{"name": "Sarah Lynn"}}
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate", ""} {
+		r := s.Raw(http.MethodGet, "/analyze?encoding="+encoding, nil)
+		assert.Nil(suite.T(), r.Error, encoding)
+		assert.Equal(suite.T(), expected, r.Data, encoding)
+		assert.Equal(suite.T(), body, string(r.Raw), encoding)
+		// Counted as received over the wire
+		assert.Equal(suite.T(), len(encodings[encoding]), metrics.BytesReceived, encoding)
+	}
+
+	for _, encoding := range []string{"broken-gzip", "unsupported"} {
+		r := s.Raw(http.MethodGet, "/analyze?encoding="+encoding, nil)
+		assert.Equal(suite.T(), ErrInvalidResponse, r.Error, encoding)
+		assert.Equal(suite.T(), body, string(r.Raw), encoding)
+	}
+}
+
+func (suite *StrideTestSuite) TestErrorPredicates() {
+	for _, err := range []error{
+		ErrServerError,
+		ErrTimeout,
+		ErrRequestFailed,
+		newAPIError(http.StatusServiceUnavailable, nil, nil),
+		newAPIError(http.StatusTooManyRequests, nil, nil),
+		newAPIError(http.StatusGatewayTimeout, nil, nil),
+		&HandshakeError{Err: ErrRequestFailed},
+		fmt.Errorf("sending batch: %w", ErrServerError),
+	} {
+		assert.True(suite.T(), IsRetryable(err), "%v", err)
+		assert.False(suite.T(), IsClientError(err), "%v", err)
+	}
+
+	for _, err := range []error{
+		ErrInvalidBody,
+		ErrInvalidPath,
+		ErrInvalidAPIKey,
+		ErrResourceMissing,
+		newAPIError(http.StatusBadRequest, nil, nil),
+		newAPIError(http.StatusForbidden, nil, nil),
+		newBodyError(map[string]interface{}{"f": func() {}}, errors.New("nope")),
+		fmt.Errorf("sending batch: %w", newAPIError(http.StatusUnauthorized, nil, nil)),
+	} {
+		assert.True(suite.T(), IsClientError(err), "%v", err)
+		assert.False(suite.T(), IsRetryable(err), "%v", err)
+	}
+
+	for _, err := range []error{nil, ErrInvalidResponse, context.Canceled} {
+		assert.False(suite.T(), IsRetryable(err), "%v", err)
+		assert.False(suite.T(), IsClientError(err), "%v", err)
+	}
+
+	// Responses to failed requests
+	s := NewStride("key", NewConfig())
+	assert.True(suite.T(), IsClientError(s.Get("/nope").Error))
+}
+
 func (suite *StrideTestSuite) TestPathValidation() {
 	assert.True(suite.T(), isPathValid(http.MethodGet, "/collect"))
 	assert.True(suite.T(), isPathValid(http.MethodPost, "/collect"))
@@ -85,6 +355,8 @@ func (suite *StrideTestSuite) TestPathValidation() {
 	assert.True(suite.T(), isPathValid(http.MethodGet, "/analyze/query/results"))
 	assert.True(suite.T(), isPathValid(http.MethodPut, "/analyze/query"))
 	assert.True(suite.T(), isPathValid(http.MethodPut, "/process/proc"))
+	assert.True(suite.T(), isPathValid(http.MethodPatch, "/analyze/query"))
+	assert.True(suite.T(), isPathValid(http.MethodPatch, "/process/proc"))
 
 	assert.False(suite.T(), isPathValid(http.MethodGet, "/collect/_stream"))
 	assert.False(suite.T(), isPathValid(http.MethodGet, "/collect/1stream"))
@@ -95,6 +367,67 @@ func (suite *StrideTestSuite) TestPathValidation() {
 	assert.False(suite.T(), isPathValid(http.MethodPut, "/collect"))
 	assert.False(suite.T(), isPathValid(http.MethodPut, "/process"))
 	assert.False(suite.T(), isPathValid(http.MethodPut, "/analyze"))
+	assert.False(suite.T(), isPathValid(http.MethodPatch, "/collect/stream"))
+	assert.False(suite.T(), isPathValid(http.MethodPatch, "/collect"))
+	assert.False(suite.T(), isPathValid(http.MethodPatch, "/process"))
+	assert.False(suite.T(), isPathValid(http.MethodPatch, "/analyze"))
+	assert.False(suite.T(), isPathValid(http.MethodPatch, "/analyze/query/results"))
+}
+
+func (suite *StrideTestSuite) TestAllowPath() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	s := NewStride("key", config)
+
+	assert.Equal(suite.T(), ErrInvalidPath, s.Get("/views/v1").Error)
+	_, err := s.Subscribe("/views/v1")
+	assert.Equal(suite.T(), ErrInvalidPath, err)
+
+	assert.Nil(suite.T(), s.AllowPath(http.MethodGet, `/views/[a-z0-9]+`))
+	assert.Nil(suite.T(), s.AllowPath("Subscribe", `/views/[a-z0-9]+`))
+	assert.Nil(suite.T(), s.Get("/views/v1").Error)
+	sub, err := s.Subscribe("/views/v1")
+	assert.Nil(suite.T(), err)
+	assert.NotNil(suite.T(), sub)
+
+	// The pattern must match the whole path, and only for its method
+	assert.Equal(suite.T(), ErrInvalidPath, s.Get("/views/v1/rows").Error)
+	assert.Equal(suite.T(), ErrInvalidPath, s.Get("/v1/views/v1").Error)
+	assert.Equal(suite.T(), ErrInvalidPath, s.Delete("/views/v1").Error)
+
+	// The defaults still apply, and other clients are unaffected
+	assert.Nil(suite.T(), s.Get("/collect").Error)
+	assert.Equal(suite.T(), ErrInvalidPath, NewStride("key", config).Get("/views/v1").Error)
+
+	assert.NotNil(suite.T(), s.AllowPath(http.MethodGet, `/views/(`))
+}
+
+func (suite *StrideTestSuite) TestRawPath() {
+	server := createMockServer(suite.T())
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	s := NewStride("key", config)
+
+	// Unknown paths are sent without validation
+	events := []map[string]interface{}{{"x": "y"}}
+	assert.Equal(suite.T(), ErrInvalidPath, s.Post("/collect/_preview", events).Error)
+	r := s.Raw(http.MethodPost, "/collect/_preview", events)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusCreated, r.StatusCode)
+	assert.Equal(suite.T(), []interface{}{map[string]interface{}{"x": "y"}}, r.Data)
+
+	r = s.Raw(http.MethodGet, "/collect", nil)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), []interface{}{"stream0", "stream1"}, r.Data)
+
+	// Errors are mapped like any other request's
+	server.Close()
+	r = s.Raw(http.MethodGet, "/collect", nil)
+	assert.Equal(suite.T(), ErrRequestFailed, r.Error)
 }
 
 func (suite *StrideTestSuite) TestMethods() {
@@ -125,12 +458,904 @@ func (suite *StrideTestSuite) TestMethods() {
 	assert.True(suite.T(), ok)
 	assert.Equal(suite.T(), proc, data)
 
+	patch := map[string]interface{}{"query": "SELECT 2"}
+	r = s.Patch("/process/p1", patch)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), patch, r.Data)
+
+	r = s.Patch("/collect/stream0", patch)
+	assert.Equal(suite.T(), ErrInvalidPath, r.Error)
+
 	r = s.Delete("/analyze/q1")
 	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
 	assert.Nil(suite.T(), r.Error)
 	assert.Nil(suite.T(), r.Data)
 }
 
+func (suite *StrideTestSuite) TestTransportError() {
+	server := createMockServer(suite.T())
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	server.Close()
+
+	s := NewStride("key", config)
+
+	r := s.Get("/collect")
+	assert.Equal(suite.T(), -1, r.StatusCode)
+	assert.Equal(suite.T(), ErrRequestFailed, r.Error)
+	assert.True(suite.T(), r.IsTransportError())
+	_, ok := r.Cause.(*url.Error)
+	assert.True(suite.T(), ok)
+
+	r = s.Get("/invalid")
+	assert.False(suite.T(), r.IsTransportError())
+	assert.Nil(suite.T(), r.Cause)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	config.Endpoint = slow.URL + "/v1"
+	s = NewStride("key", config)
+
+	r = s.Get("/collect", WithTimeout(10*time.Millisecond))
+	assert.Equal(suite.T(), ErrTimeout, r.Error)
+	assert.True(suite.T(), r.IsTransportError())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = s.GetContext(ctx, "/collect")
+	assert.Equal(suite.T(), context.Canceled, r.Error)
+	assert.True(suite.T(), r.IsTransportError())
+}
+
+func (suite *StrideTestSuite) TestObserver() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	var metrics []*RequestMetrics
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Observer = func(m *RequestMetrics) {
+		metrics = append(metrics, m)
+	}
+
+	s := NewStride("key", config)
+	s.Get("/collect")
+	s.Post("/process/p1", map[string]interface{}{"query": "SELECT 1"})
+	s.Post("/collect/s0", []map[string]interface{}{{"x": "x"}})
+
+	assert.Equal(suite.T(), 3, len(metrics))
+	assert.Equal(suite.T(), http.MethodGet, metrics[0].Method)
+	assert.Equal(suite.T(), "/collect", metrics[0].Path)
+	assert.Equal(suite.T(), http.StatusOK, metrics[0].StatusCode)
+	assert.Equal(suite.T(), 0, metrics[0].BytesSent)
+	assert.Equal(suite.T(), len(`["stream0", "stream1"]`), metrics[0].BytesReceived)
+
+	assert.Equal(suite.T(), http.StatusCreated, metrics[1].StatusCode)
+	assert.Equal(suite.T(), len(`{"query":"SELECT 1"}`), metrics[1].BytesSent)
+	assert.Equal(suite.T(), metrics[1].BytesSent, metrics[1].BytesReceived)
+	assert.Equal(suite.T(), "", metrics[1].ContentEncoding)
+
+	assert.Equal(suite.T(), "gzip", metrics[2].ContentEncoding)
+}
+
+func (suite *StrideTestSuite) TestLogFieldsFromContext() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	type key string
+	var fields []map[string]interface{}
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.LogFieldsFromContext = func(ctx context.Context) map[string]interface{} {
+		f := map[string]interface{}{"trace_id": ctx.Value(key("trace"))}
+		fields = append(fields, f)
+		return f
+	}
+
+	s := NewStride("key", config)
+	ctx := context.WithValue(context.Background(), key("trace"), "abc123")
+	r := s.makeRequest(ctx, http.MethodGet, "/collect", nil)
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), []map[string]interface{}{{"trace_id": "abc123"}}, fields)
+}
+
+func (suite *StrideTestSuite) TestRootCAs() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	// The test server's certificate is self-signed
+	r := NewStride("key", config).Get("/collect")
+	assert.True(suite.T(), r.IsTransportError())
+
+	cert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	assert.Nil(suite.T(), err)
+	config.RootCAs = x509.NewCertPool()
+	config.RootCAs.AddCert(cert)
+
+	r = NewStride("key", config).Get("/collect")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+}
+
+func (suite *StrideTestSuite) TestConnectTransport() {
+	assert.Nil(suite.T(), newConnectTransport(nil, 0))
+
+	def := http.DefaultTransport.(*http.Transport)
+	t := newConnectTransport(x509.NewCertPool(), time.Second).(*http.Transport)
+	assert.True(suite.T(), t.ForceAttemptHTTP2)
+	assert.Equal(suite.T(), def.MaxIdleConns, t.MaxIdleConns)
+	assert.Equal(suite.T(), def.IdleConnTimeout, t.IdleConnTimeout)
+	assert.Equal(suite.T(), def.ExpectContinueTimeout, t.ExpectContinueTimeout)
+	assert.Equal(suite.T(), time.Second, t.TLSHandshakeTimeout)
+	assert.NotNil(suite.T(), t.TLSClientConfig.RootCAs)
+	if def.TLSClientConfig != nil {
+		assert.Nil(suite.T(), def.TLSClientConfig.RootCAs)
+	}
+}
+
+func (suite *StrideTestSuite) TestContextMethods() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/collect/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	s := NewStride("key", config)
+	ctx := context.Background()
+
+	assert.Nil(suite.T(), s.GetContext(ctx, "/collect").Error)
+	assert.Nil(suite.T(), s.PostContext(ctx, "/collect/s0", []interface{}{}).Error)
+	assert.Nil(suite.T(), s.PutContext(ctx, "/process/p1", map[string]interface{}{}).Error)
+	assert.Nil(suite.T(), s.DeleteContext(ctx, "/process/p1").Error)
+
+	// Cancelled contexts fail with the context's error
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	r := s.GetContext(cctx, "/collect")
+	assert.Equal(suite.T(), context.Canceled, r.Error)
+	assert.NotNil(suite.T(), r.Cause)
+
+	// As do those reaching their deadline before the server responds
+	dctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r = s.GetContext(dctx, "/collect/slow")
+	assert.Equal(suite.T(), context.DeadlineExceeded, r.Error)
+	assert.True(suite.T(), time.Since(start) < config.Timeout)
+}
+
+func (suite *StrideTestSuite) TestRaw() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/collect":
+			w.Write([]byte(`["stream0"]`))
+		case "/v1/process":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>Bad Gateway</html>"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	s := NewStride("key", config)
+
+	r := s.Get("/collect")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), []interface{}{"stream0"}, r.Data)
+	assert.Equal(suite.T(), `["stream0"]`, string(r.Raw))
+
+	r = s.Get("/process")
+	assert.Equal(suite.T(), ErrInvalidResponse, r.Error)
+	assert.Nil(suite.T(), r.Data)
+	assert.Equal(suite.T(), "<html>Bad Gateway</html>", string(r.Raw))
+
+	r = s.Get("/process/p0")
+	assert.True(suite.T(), errors.Is(r.Error, ErrResourceMissing))
+	assert.Equal(suite.T(), `{"error": "not found"}`, string(r.Raw))
+}
+
+func (suite *StrideTestSuite) TestGetInto() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/analyze/q1/results":
+			w.Write([]byte(`{"columns": ["user", "count"], "data": [["cartman", 3]]}`))
+		case "/v1/analyze/q2/results":
+			w.Write([]byte(`{"columns": "user"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	s := NewStride("key", config)
+
+	type results struct {
+		Columns []string        `json:"columns"`
+		Data    [][]interface{} `json:"data"`
+	}
+
+	var res results
+	assert.Nil(suite.T(), s.GetInto("/analyze/q1/results", &res))
+	assert.Equal(suite.T(), []string{"user", "count"}, res.Columns)
+	assert.Equal(suite.T(), [][]interface{}{{"cartman", float64(3)}}, res.Data)
+
+	res = results{Columns: []string{"untouched"}}
+	assert.True(suite.T(), errors.Is(s.GetInto("/analyze/q3/results", &res), ErrResourceMissing))
+	assert.Equal(suite.T(), []string{"untouched"}, res.Columns)
+
+	_, ok := s.GetInto("/analyze/q2/results", &res).(*json.UnmarshalTypeError)
+	assert.True(suite.T(), ok)
+}
+
+func (suite *StrideTestSuite) TestAPIError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/process/p1":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "field query is required"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	s := NewStride("key", config)
+
+	r := s.Post("/process/p1", map[string]interface{}{})
+	assert.True(suite.T(), errors.Is(r.Error, ErrInvalidBody))
+	apiErr, ok := r.Error.(*APIError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(suite.T(), "field query is required", apiErr.Message)
+	assert.Equal(suite.T(), "Invalid request body (400): field query is required", r.Error.Error())
+
+	r = s.Get("/analyze/q1")
+	assert.True(suite.T(), errors.Is(r.Error, ErrServerError))
+	assert.False(suite.T(), errors.Is(r.Error, ErrInvalidBody))
+	assert.Equal(suite.T(), "Stride API returned an invalid status code (500)", r.Error.Error())
+}
+
+func (suite *StrideTestSuite) TestCollectSync() {
+	server := createMockServer(suite.T())
+	defer server.Close()
+
+	var metrics *RequestMetrics
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Observer = func(m *RequestMetrics) { metrics = m }
+	s := NewStride("key", config)
+
+	r := s.CollectSync(map[string][]map[string]interface{}{
+		"s0": {{"x": "x"}, {"y": "y"}},
+		"s1": {{"z": "z"}},
+	})
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusCreated, r.StatusCode)
+	assert.Equal(suite.T(), map[string]interface{}{
+		"s0": []interface{}{map[string]interface{}{"x": "x"}, map[string]interface{}{"y": "y"}},
+		"s1": []interface{}{map[string]interface{}{"z": "z"}},
+	}, r.Data)
+	assert.Equal(suite.T(), "/collect", metrics.Path)
+	assert.Equal(suite.T(), "gzip", metrics.ContentEncoding)
+}
+
+func (suite *StrideTestSuite) TestWithHeader() {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	r := s.Post("/collect/s0", []string{"x"},
+		WithHeader("X-Request-ID", "abc"),
+		WithHeader("x-trace", "1"),
+		WithHeader("X-Trace", "2"),
+		WithHeader("Authorization", "Bearer nope"),
+		WithHeader("Content-Type", "text/plain"),
+		WithHeader("Content-Encoding", "br"))
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), "abc", header.Get("X-Request-ID"))
+	assert.Equal(suite.T(), []string{"1", "2"}, header["X-Trace"])
+	assert.Equal(suite.T(), "application/json", header.Get("Content-Type"))
+	assert.Equal(suite.T(), "gzip", header.Get("Content-Encoding"))
+	user, _, _ := (&http.Request{Header: header}).BasicAuth()
+	assert.Equal(suite.T(), "key", user)
+
+	s.Get("/collect")
+	assert.Equal(suite.T(), "", header.Get("X-Request-ID"))
+}
+
+func (suite *StrideTestSuite) TestWithTimeout() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Timeout = 50 * time.Millisecond
+	s := NewStride("key", config)
+
+	r := s.Get("/analyze/a1/results")
+	assert.Equal(suite.T(), ErrTimeout, r.Error)
+	assert.NotNil(suite.T(), r.Cause)
+
+	// Overrides the config's Timeout, whether it's longer
+	r = s.Get("/analyze/a1/results", WithTimeout(time.Second))
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+
+	// or shorter
+	config.Timeout = 5 * time.Second
+	s = NewStride("key", config)
+	r = s.Get("/analyze/a1/results", WithTimeout(50*time.Millisecond))
+	assert.Equal(suite.T(), ErrTimeout, r.Error)
+	assert.NotNil(suite.T(), r.Cause)
+
+	// The context's own deadline still applies
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r = s.GetContext(ctx, "/analyze/a1/results", WithTimeout(time.Second))
+	assert.Equal(suite.T(), context.DeadlineExceeded, r.Error)
+}
+
+func (suite *StrideTestSuite) TestIdempotencyKey() {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	s.Post("/collect/s0", []string{"x"}, WithIdempotencyKey("k1"))
+	s.Put("/process/p1", map[string]interface{}{}, WithIdempotencyKey("k2"), WithIdempotencyKey("k3"))
+	s.Post("/collect/s0", []string{"x"})
+	assert.Equal(suite.T(), []string{"k1", "k3", ""}, keys)
+
+	assert.Regexp(suite.T(), "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", newIdempotencyKey())
+	assert.NotEqual(suite.T(), newIdempotencyKey(), newIdempotencyKey())
+}
+
+func (suite *StrideTestSuite) TestDeleteIfExists() {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	r := s.DeleteIfExists("/collect/s0")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+
+	status = http.StatusNotFound
+	assert.True(suite.T(), errors.Is(s.Delete("/collect/s0").Error, ErrResourceMissing))
+	r = s.DeleteIfExists("/collect/s0")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusNotFound, r.StatusCode)
+
+	status = http.StatusForbidden
+	assert.True(suite.T(), errors.Is(s.DeleteIfExists("/collect/s0").Error, ErrInvalidAPIKey))
+	assert.Equal(suite.T(), ErrInvalidPath, s.DeleteIfExists("/collect").Error)
+}
+
+// doerFunc is a fake Doer
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (suite *StrideTestSuite) TestClient() {
+	var paths []string
+	config := NewConfig()
+	config.Client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString(`["s0", "s1"]`)),
+		}, nil
+	})
+	s := NewStride("key", config)
+
+	streams, err := s.ListStreams()
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []string{"s0", "s1"}, streams)
+
+	// Per-request timeouts don't need an *http.Client
+	r := s.Get("/process", WithTimeout(time.Second))
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), []string{"/v1/collect", "/v1/process"}, paths)
+
+	config.Client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("no route to host")
+	})
+	r = NewStride("key", config).Get("/process")
+	assert.Equal(suite.T(), ErrRequestFailed, r.Error)
+	assert.Equal(suite.T(), "no route to host", r.Cause.Error())
+}
+
+func (suite *StrideTestSuite) TestDryRun() {
+	logger := &mockLogger{}
+	codec := &countingCodec{}
+	config := NewConfig()
+	config.Logger = logger
+	config.DryRun = true
+	config.Codec = codec
+	var sent int32
+	config.Client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&sent, 1)
+		return nil, errors.New("request sent in a dry run")
+	})
+	s := NewStride("key", config)
+
+	r := s.Post("/collect/s0", []map[string]interface{}{{"name": "Princess Carolyn"}})
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), http.StatusOK, r.StatusCode)
+	assert.Equal(suite.T(), int32(0), atomic.LoadInt32(&sent))
+
+	line := logger.find("Dry run, not sending request")
+	assert.NotNil(suite.T(), line)
+	assert.Equal(suite.T(), "debug", line.level)
+	assert.Equal(suite.T(), "/collect/s0", line.fields["path"])
+	assert.Equal(suite.T(), `[{"name":"Princess Carolyn"}]`, line.fields["payload"])
+	// The logged payload is the one that was encoded, not encoded again
+	assert.Equal(suite.T(), int64(1), atomic.LoadInt64(&codec.marshals))
+
+	// Including by the config's Encoders
+	logger.lines = nil
+	config.Encoders = []EncoderRule{{Pattern: regexp.MustCompile("^/process"), Encoder: GzipJSONEncoder}}
+	r = NewStride("key", config).Post("/process/p0", map[string]interface{}{"query": "select 1"})
+	assert.Nil(suite.T(), r.Error)
+	line = logger.find("Dry run, not sending request")
+	assert.Equal(suite.T(), `{"query":"select 1"}`, line.fields["payload"])
+
+	// Bodies that fail to encode still fail the request
+	r = s.Post("/collect/s0", []map[string]interface{}{{"f": func() {}}})
+	assert.NotNil(suite.T(), r.Error)
+}
+
+func (suite *StrideTestSuite) TestRateLimit() {
+	remaining := "1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(RateLimitLimitHeader, "100")
+		w.Header().Set(RateLimitRemainingHeader, remaining)
+		w.Header().Set(RateLimitResetHeader, "1473670800")
+		if remaining == "0" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	r := s.Get("/process")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), &RateLimit{Limit: 100, Remaining: 1, Reset: time.Unix(1473670800, 0)}, r.RateLimit)
+
+	remaining = "0"
+	r = s.Get("/process")
+	assert.NotNil(suite.T(), r.Error)
+	assert.Equal(suite.T(), 0, r.RateLimit.Remaining)
+}
+
+func (suite *StrideTestSuite) TestThrottle() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.RateLimit.RequestsPerSecond = 20
+	s := NewStride("key", config)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.Nil(suite.T(), s.Get("/process").Error)
+	}
+	assert.True(suite.T(), time.Since(start) >= 200*time.Millisecond)
+
+	// Waiting for a turn past the request's deadline times out
+	r := s.Get("/process", WithTimeout(time.Millisecond))
+	assert.Equal(suite.T(), ErrTimeout, r.Error)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = s.GetContext(ctx, "/process")
+	assert.Equal(suite.T(), context.Canceled, r.Error)
+
+	// Unthrottled by default
+	config.RateLimit.RequestsPerSecond = 0
+	assert.Nil(suite.T(), NewStride("key", config).limiter)
+}
+
+func (suite *StrideTestSuite) TestRetryAfter() {
+	var requests []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set(RetryAfterHeader, "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Retry.MaxRetries = 1
+	config.Retry.InitialInterval = time.Millisecond
+	s := NewStride("key", config)
+
+	r := s.Get("/process")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), 2, len(requests))
+	assert.True(suite.T(), requests[1].Sub(requests[0]) >= time.Second)
+
+	// The wait is capped at MaxInterval
+	requests = nil
+	config.Retry.MaxInterval = 50 * time.Millisecond
+	r = s.Get("/process")
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), 2, len(requests))
+	assert.True(suite.T(), requests[1].Sub(requests[0]) < time.Second)
+
+	// and the request isn't retried if its deadline would pass while waiting
+	requests = nil
+	config.Retry.MaxInterval = 5 * time.Second
+	r = s.Get("/process", WithTimeout(100*time.Millisecond))
+	assert.Equal(suite.T(), http.StatusTooManyRequests, r.StatusCode)
+	assert.Equal(suite.T(), 1, len(requests))
+}
+
+type spanKey struct{}
+
+type span struct {
+	name       string
+	statusCode int
+	err        error
+}
+
+// mockTracer records its spans, and propagates their names in a Span header
+type mockTracer struct {
+	mu    sync.Mutex
+	spans []span
+}
+
+func (t *mockTracer) StartSpan(ctx context.Context, name string) (context.Context, func(int, error)) {
+	return context.WithValue(ctx, spanKey{}, name), func(statusCode int, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, span{name, statusCode, err})
+	}
+}
+
+func (t *mockTracer) Inject(ctx context.Context, header http.Header) {
+	header.Set("Span", ctx.Value(spanKey{}).(string))
+}
+
+func (t *mockTracer) finished() []span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]span(nil), t.spans...)
+}
+
+func (suite *StrideTestSuite) TestTracer() {
+	var headers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Span"))
+		if r.URL.Path == "/process/p2" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	tracer := &mockTracer{}
+	config := NewConfig()
+	config.Endpoint = server.URL
+	config.Tracer = tracer
+	s := NewStride("key", config)
+
+	assert.Nil(suite.T(), s.Get("/process/p1").Error)
+	assert.True(suite.T(), errors.Is(s.Delete("/process/p2").Error, ErrResourceMissing))
+	server.Close()
+	assert.Equal(suite.T(), ErrRequestFailed, s.Get("/process/p1").Error)
+
+	assert.Equal(suite.T(), []string{"GET /process/p1", "DELETE /process/p2"}, headers)
+	spans := tracer.finished()
+	assert.Equal(suite.T(), 3, len(spans))
+	assert.Equal(suite.T(), span{"GET /process/p1", http.StatusOK, nil}, spans[0])
+	assert.Equal(suite.T(), "DELETE /process/p2", spans[1].name)
+	assert.Equal(suite.T(), http.StatusNotFound, spans[1].statusCode)
+	assert.True(suite.T(), errors.Is(spans[1].err, ErrResourceMissing))
+	assert.Equal(suite.T(), span{"GET /process/p1", -1, ErrRequestFailed}, spans[2])
+}
+
+func (suite *StrideTestSuite) TestUserAgent() {
+	agents := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+	s.Get("/process")
+	assert.Equal(suite.T(), "gostride (version: "+Version+")", <-agents)
+
+	config.UserAgent = "bojack/1.0"
+	s.Get("/process")
+	assert.Equal(suite.T(), "gostride (version: "+Version+") bojack/1.0", <-agents)
+
+	sub, _ := s.Subscribe("/collect/stream")
+	sub.Start()
+	assert.Equal(suite.T(), "gostride (version: "+Version+") bojack/1.0", <-agents)
+	sub.Stop()
+}
+
+func (suite *StrideTestSuite) TestPing() {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _, _ := r.BasicAuth(); r.URL.Path != "/collect" || user != "key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+
+	config := NewConfig()
+	config.Endpoint = server.URL
+	s := NewStride("key", config)
+
+	assert.Nil(suite.T(), s.Ping(context.Background()))
+	status = http.StatusNoContent
+	assert.Nil(suite.T(), s.Ping(context.Background()))
+
+	status = http.StatusUnauthorized
+	assert.True(suite.T(), errors.Is(s.Ping(context.Background()), ErrInvalidAPIKey))
+	status = http.StatusForbidden
+	assert.True(suite.T(), errors.Is(s.Ping(context.Background()), ErrInvalidAPIKey))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(suite.T(), context.Canceled, s.Ping(ctx))
+
+	server.Close()
+	assert.Equal(suite.T(), ErrRequestFailed, s.Ping(context.Background()))
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	config.Endpoint = slow.URL
+	config.Timeout = 50 * time.Millisecond
+	assert.Equal(suite.T(), ErrTimeout, NewStride("key", config).Ping(context.Background()))
+}
+
+func (suite *StrideTestSuite) TestEndpoint() {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	for _, endpoint := range []string{"", "/", "/api/v1", "/api/v1/"} {
+		config := NewConfig()
+		config.Endpoint = server.URL + endpoint
+		assert.Nil(suite.T(), NewStride("key", config).Get("/collect").Error)
+	}
+	assert.Equal(suite.T(), []string{"/collect", "/collect", "/api/v1/collect", "/api/v1/collect"}, paths)
+
+	for _, endpoint := range []string{"", "api.stride.io/v1", "/v1", "ftp://api.stride.io", "http://", "https://api.stride.io/v1?x=1", "http://%zz"} {
+		config := NewConfig()
+		config.Endpoint = endpoint
+		assert.Panics(suite.T(), func() { NewStride("key", config) }, endpoint)
+	}
+}
+
+func (suite *StrideTestSuite) TestRetry() {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+string(body))
+		if len(requests)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var metrics *RequestMetrics
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Observer = func(m *RequestMetrics) { metrics = m }
+	config.Retry.MaxRetries = 3
+	config.Retry.InitialInterval = time.Millisecond
+
+	s := NewStride("key", config)
+
+	// The body is replayed on each attempt
+	r := s.Put("/process/p1", map[string]interface{}{"query": "SELECT 1"})
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), 2, metrics.Retries)
+	assert.Equal(suite.T(), 3, len(requests))
+	for _, req := range requests {
+		assert.Equal(suite.T(), `PUT {"query":"SELECT 1"}`, req)
+	}
+
+	// POSTs that reached the server aren't retried
+	requests = nil
+	r = s.Post("/process/p1", map[string]interface{}{"query": "SELECT 1"})
+	assert.True(suite.T(), errors.Is(r.Error, ErrServerError))
+	assert.Equal(suite.T(), 0, metrics.Retries)
+	assert.Equal(suite.T(), 1, len(requests))
+
+	// unless they have an idempotency key
+	requests = nil
+	r = s.Post("/process/p1", map[string]interface{}{"query": "SELECT 1"}, WithIdempotencyKey("k1"))
+	assert.Nil(suite.T(), r.Error)
+	assert.Equal(suite.T(), 2, metrics.Retries)
+	assert.Equal(suite.T(), 3, len(requests))
+
+	// and likewise for PATCHes
+	requests = nil
+	r = s.Patch("/process/p1", map[string]interface{}{"query": "SELECT 1"})
+	assert.True(suite.T(), errors.Is(r.Error, ErrServerError))
+	assert.Equal(suite.T(), 0, metrics.Retries)
+	assert.Equal(suite.T(), 1, len(requests))
+
+	// The last response is returned once retries are exhausted
+	requests = nil
+	config.Retry.MaxRetries = 1
+	r = s.Get("/collect")
+	assert.Equal(suite.T(), http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(suite.T(), 1, metrics.Retries)
+	assert.Equal(suite.T(), 2, len(requests))
+
+	// POSTs are retried if the connection couldn't be established
+	server.Close()
+	r = s.Post("/process/p1", map[string]interface{}{"query": "SELECT 1"})
+	assert.Equal(suite.T(), ErrRequestFailed, r.Error)
+	assert.Equal(suite.T(), 1, metrics.Retries)
+}
+
 func TestStrideTestSuite(t *testing.T) {
 	suite.Run(t, new(StrideTestSuite))
 }
+
+// peakHeap runs f while sampling the heap, returning how much it grew by at
+// most. The garbage collector runs aggressively meanwhile, so that the heap
+// reflects the memory f holds on to rather than how much garbage it leaves.
+func peakHeap(f func()) uint64 {
+	defer debug.SetGCPercent(debug.SetGCPercent(1))
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > base && m.HeapAlloc-base > peak {
+				peak = m.HeapAlloc - base
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	f()
+	close(done)
+	<-sampled
+	return peak
+}
+
+// BenchmarkCompressLargeBatch compares the peak memory of buffering a large
+// batch's compressed body with streaming it, e.g. to the transport
+func BenchmarkCompressLargeBatch(b *testing.B) {
+	events := make([]map[string]interface{}, 100000)
+	for i := range events {
+		events[i] = map[string]interface{}{
+			"$id":  fmt.Sprintf("event-%d", i),
+			"user": fmt.Sprintf("user-%d", i%50),
+			"tags": []string{"a", "b", "c"},
+			"n":    i,
+		}
+	}
+	batch := map[string][]map[string]interface{}{"s0": events}
+
+	bench := func(b *testing.B, send func() error) {
+		var peak uint64
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var err error
+			if p := peakHeap(func() { err = send() }); p > peak {
+				peak = p
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(peak), "peak-heap-B")
+	}
+
+	b.Run("buffered", func(b *testing.B) {
+		bench(b, func() error {
+			body, err := compressBody(StdCodec{}, batch, nil)
+			if err != nil {
+				return err
+			}
+			defer body.release()
+			_, err = io.Copy(ioutil.Discard, body.reader())
+			return err
+		})
+	})
+	b.Run("streamed", func(b *testing.B) {
+		bench(b, func() error {
+			r := newStreamedBody(StdCodec{}, batch).reader()
+			defer r.Close()
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		})
+	})
+}
+
+func BenchmarkCompressJSON(b *testing.B) {
+	events := make([]map[string]interface{}, 1000)
+	for i := range events {
+		events[i] = map[string]interface{}{"user": "user", "n": i}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := compressJSON(StdCodec{}, events, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,13 +3,19 @@ package stride
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/cenkalti/backoff"
 
 	tomb "gopkg.in/tomb.v2"
@@ -17,15 +23,89 @@ import (
 
 const delimiter = "\r\n"
 
+// stateBuffer is the capacity of a Subscription's State channel
+const stateBuffer = 16
+
+// ConnStatus is the status of a Subscription's connection
+type ConnStatus int
+
+const (
+	// StateConnecting is the first attempt to connect
+	StateConnecting ConnStatus = iota
+	// StateConnected is an established connection
+	StateConnected
+	// StateDisconnected is a lost connection or failed attempt to connect
+	StateDisconnected
+	// StateReconnecting is a further attempt to connect
+	StateReconnecting
+	// StateStopped is a Subscription that has stopped for good
+	StateStopped
+)
+
+func (s ConnStatus) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateStopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("ConnStatus(%d)", int(s))
+}
+
+// ConnState is a transition of a Subscription's connection
+type ConnState struct {
+	Status ConnStatus
+
+	// Err is why the connection was lost, the attempt to connect failed or the
+	// Subscription stopped, if known
+	Err error
+}
+
 // Subscription is a utility that exposes /subscribe endpoints
 type Subscription struct {
-	apiKey    string
+	// Stats, accessed atomically so they must stay 64-bit aligned
+	coalesced int64
+	dropped   int64
+	delivered int64
+	filtered  int64
+
+	auth      *credentials
 	path      string
-	client    *http.Client
+	client    Doer
+	codec     Codec
 	config    *Config
 	tomb      tomb.Tomb
-	connected bool
+	connected int32 // Accessed atomically
 	Events    chan map[string]interface{}
+
+	// State receives the transitions of the Subscription's connection, and is
+	// closed once it stops. Reading it is optional: transitions are discarded
+	// while its buffer is full.
+	State <-chan ConnState
+	state chan ConnState
+
+	// resumed is non-nil while the Subscription is paused, and is closed on Resume
+	pauseMu sync.Mutex
+	resumed chan struct{}
+
+	// Previous event, for coalescing
+	prevToken []byte
+	prevEvent map[string]interface{}
+
+	// Position to request historical events from, cleared once caught up
+	since string
+
+	// Position of the last event delivered
+	positionMu sync.Mutex
+	position   string
+
+	errors *errorLimiter
 }
 
 func newSubscription(apiKey, path string, config *Config) *Subscription {
@@ -33,14 +113,30 @@ func newSubscription(apiKey, path string, config *Config) *Subscription {
 		config = defaultConfig
 	}
 
+	var client Doer = &http.Client{Transport: newConnectTransport(config.RootCAs, config.Subscription.ConnectTimeout)}
+	if config.Client != nil {
+		client = config.Client
+	}
+
+	state := make(chan ConnState, stateBuffer)
 	return &Subscription{
-		apiKey,
-		path,
-		&http.Client{},
-		config,
-		tomb.Tomb{},
-		false,
-		make(chan map[string]interface{}),
+		auth:   newCredentials(config.Auth, apiKey),
+		path:   path,
+		client: client,
+		codec:  orStdCodec(config.Codec),
+		config: config,
+		Events: make(chan map[string]interface{}, config.Subscription.BufferSize),
+		State:  state,
+		state:  state,
+		errors: newErrorLimiter(config.ErrorLogInterval),
+	}
+}
+
+// setState reports a transition on State, unless its buffer is full
+func (s *Subscription) setState(status ConnStatus, err error) {
+	select {
+	case s.state <- ConnState{Status: status, Err: err}:
+	default:
 	}
 }
 
@@ -49,56 +145,161 @@ func (s *Subscription) Start() {
 	s.tomb.Go(s.start)
 }
 
-func (s *Subscription) start() error {
-	url := fmt.Sprintf("%s%s/subscribe", s.config.Endpoint, s.path)
+// StartFrom listens for events async, first replaying historical events since
+// the given position, if the server supports it. since is either a time.Time
+// or a server-specific position such as an event ID. The server marks the end
+// of historical events with its first keep-alive, at which point the config's
+// Subscription.OnLive is called. Reconnects after that only receive live events.
+func (s *Subscription) StartFrom(since interface{}) {
+	switch v := since.(type) {
+	case time.Time:
+		s.since = v.Format(time.RFC3339Nano)
+	default:
+		s.since = fmt.Sprint(v)
+	}
+	s.Start()
+}
 
-	lg := log.WithFields(logrus.Fields{
-		"url":      url,
-		"module":   "subscription",
-		"function": "Start",
-	})
+// Position returns the position of the last event delivered over Events, i.e.
+// its $id, or else its $timestamp, or "" if no event with either was
+// delivered yet. Passing it to StartFrom, e.g. after a restart, resumes the
+// stream from that event.
+func (s *Subscription) Position() string {
+	s.positionMu.Lock()
+	defer s.positionMu.Unlock()
+	return s.position
+}
 
-	b := backoff.NewExponentialBackOff()
-	b.InitialInterval = s.config.Subscription.InitialInterval
-	b.Multiplier = 2
-	b.MaxInterval = s.config.Subscription.MaxInterval
-	b.Reset()
+// eventPosition returns the position of an event, or "" if it has none
+func eventPosition(event map[string]interface{}) string {
+	for _, key := range []string{ID, Timestamp} {
+		if v, ok := event[key]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+func (s *Subscription) newRequest(url string) *http.Request {
+	since := s.since
+	if since == "" && s.config.Subscription.Resume {
+		since = s.Position()
+	}
+	if since != "" {
+		url += "?since=" + neturl.QueryEscape(since)
+	}
 
 	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("User-Agent", fmt.Sprintf("gostride (version: %s)", Version))
+	req.Header.Add("User-Agent", userAgent(s.config.UserAgent))
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
-	req.SetBasicAuth(s.apiKey, "")
+	s.auth.Apply(req)
+
+	return req
+}
+
+// connect sends the request for the Subscription's stream, in a span of its
+// own if there's a Tracer. The span ends once the response's headers arrive.
+func (s *Subscription) connect(ctx context.Context, url string) (*http.Response, error) {
+	req := s.newRequest(url)
+	if s.config.Tracer == nil {
+		return s.client.Do(req.WithContext(ctx))
+	}
+
+	ctx, finish := s.config.Tracer.StartSpan(ctx, "GET "+s.path+"/subscribe")
+	s.config.Tracer.Inject(ctx, req.Header)
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		finish(-1, err)
+	} else {
+		finish(resp.StatusCode, errorFromStatusCode(resp.StatusCode))
+	}
+	return resp, err
+}
+
+func (s *Subscription) start() (err error) {
+	defer func() {
+		s.setState(StateStopped, err)
+		close(s.state)
+	}()
+
+	url := joinURL(s.config.Endpoint, s.path+"/subscribe")
+
+	lg := newEntry(s.config.Logger, Fields{
+		"url":      url,
+		"module":   "subscription",
+		"function": "Start",
+	})
+
+	b := s.newBackOff()
 
 	var wait time.Duration
+	status := StateConnecting
 	for {
-		resp, err := s.client.Do(req)
+		var retryAfter time.Duration
+		var hasRetryAfter bool
+
+		s.setState(status, nil)
+		status = StateReconnecting
+
+		// Bound the handshake by Timeout, but not the stream that follows it
+		ctx, cancel := context.WithCancel(context.Background())
+		var handshake *time.Timer
+		if s.config.Timeout > 0 {
+			handshake = time.AfterFunc(s.config.Timeout, cancel)
+		}
+		resp, err := s.connect(ctx, url)
+		timedOut := handshake != nil && !handshake.Stop()
 		if err != nil {
-			lg.WithError(err).Error("Request to Stride API failed")
-			return ErrRequestFailed
+			cancel()
+			s.errors.error(lg.WithError(err), "Request to Stride API failed")
+			herr := &HandshakeError{URL: url, Err: ErrRequestFailed, Cause: err}
+			if nerr, ok := err.(net.Error); timedOut || ok && nerr.Timeout() {
+				herr.Err = ErrTimeout
+			}
+			return herr
 		}
-		defer resp.Body.Close()
 
 		switch resp.StatusCode {
 		case 200:
-			s.connected = true
-			s.receive(resp.Body)
-			s.connected = false
+			atomic.StoreInt32(&s.connected, 1)
+			s.setState(StateConnected, nil)
+			err := s.receive(resp.Body)
+			atomic.StoreInt32(&s.connected, 0)
+			s.setState(StateDisconnected, err)
 			b.Reset()
 		case 429, 500, 504:
-			lg.WithField("status_code", resp.StatusCode).Error("Invalid status code")
-		case 404:
-			return ErrResourceMissing
+			s.errors.error(lg.WithField("status_code", resp.StatusCode), "Invalid status code")
+			s.setState(StateDisconnected, newHandshakeError(url, resp))
+			if resp.StatusCode == http.StatusTooManyRequests {
+				retryAfter, hasRetryAfter = parseRetryAfter(resp.Header, time.Now())
+			}
 		default:
-			return ErrServerError
+			herr := newHandshakeError(url, resp)
+			resp.Body.Close()
+			cancel()
+			return herr
 		}
 
+		resp.Body.Close()
+		cancel()
+
 		wait = b.NextBackOff()
 		if wait == backoff.Stop {
 			return ErrTimeout
 		}
+		// The server knows best when it'll accept us again, though it's capped
+		// at MaxInterval like a request's, and counts towards MaxElapsedTime
+		if hasRetryAfter {
+			wait = retryAfter
+			if max := s.config.Subscription.MaxInterval; max > 0 && wait > max {
+				wait = max
+			}
+			if max := s.config.Subscription.MaxElapsedTime; max > 0 && b.GetElapsedTime()+wait > max {
+				return ErrTimeout
+			}
+		}
 
-		resp.Body.Close()
 		select {
 		case <-time.After(wait):
 		case <-s.tomb.Dying():
@@ -107,6 +308,66 @@ func (s *Subscription) start() error {
 	}
 }
 
+// newBackOff returns the backoff between reconnects
+func (s *Subscription) newBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = s.config.Subscription.InitialInterval
+	b.RandomizationFactor = s.config.Subscription.RandomizationFactor
+	b.Multiplier = 2
+	b.MaxInterval = s.config.Subscription.MaxInterval
+	b.MaxElapsedTime = s.config.Subscription.MaxElapsedTime
+	b.Reset()
+	return b
+}
+
+// maxHandshakeBody bounds how much of a failed handshake's response body is
+// kept in its HandshakeError
+const maxHandshakeBody = 512
+
+// HandshakeError is returned when a Subscription fails to connect. Err is the
+// error for the failure, e.g. ErrInvalidAPIKey for a 401 or 403 response, or
+// ErrTimeout if the server didn't respond within the config's Timeout.
+type HandshakeError struct {
+	URL string
+
+	// StatusCode and the start of the body of the response, if one was received
+	StatusCode int
+	Body       string
+
+	Err error
+
+	// Cause is the underlying error if no response was received
+	Cause error
+}
+
+func newHandshakeError(url string, resp *http.Response) *HandshakeError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHandshakeBody))
+	return &HandshakeError{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+		Err:        errorFromStatusCode(resp.StatusCode),
+	}
+}
+
+func (e *HandshakeError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("Subscription to %s failed: %s: %s", e.URL, e.Err, e.Cause)
+	}
+
+	msg := fmt.Sprintf("Subscription to %s failed with %d %s: %s",
+		e.URL, e.StatusCode, strings.ToLower(http.StatusText(e.StatusCode)), e.Err)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// Unwrap returns Err
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
 // scanLines is a split function for a Scanner that returns each line of text
 // stripped of the end-of-line marker "\r\n" used by Stride Subscription API.
 func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -129,17 +390,28 @@ func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
-func (s *Subscription) receive(body io.ReadCloser) {
-	lg := log.WithFields(logrus.Fields{
+// receive delivers the events read from body until it ends or the Subscription
+// is stopped, returning the error reading it, if any
+func (s *Subscription) receive(body io.ReadCloser) error {
+	lg := newEntry(s.config.Logger, Fields{
 		"module":   "subscription",
 		"function": "receive",
 	})
 
 	scanner := bufio.NewScanner(body)
 	scanner.Split(scanLines)
+	if max := s.config.Subscription.MaxEventSize; max > 0 {
+		// The scanner's limit is the larger of max and its initial buffer
+		size := max + len(delimiter)
+		if size > bufio.MaxScanTokenSize {
+			size = bufio.MaxScanTokenSize
+		}
+		scanner.Buffer(make([]byte, 0, size), max+len(delimiter))
+	}
 
 	tokenCh := make(chan []byte)
 	exited := false
+	var readErr error
 
 	go func() {
 		for scanner.Scan() {
@@ -148,45 +420,237 @@ func (s *Subscription) receive(body io.ReadCloser) {
 		// Don't log any connection errors thrown as a result of this Subscription's
 		// underlying connection being purposely closed
 		if !exited && scanner.Err() != nil {
-			lg.WithError(scanner.Err()).Error("Error reading data")
+			s.errors.error(lg.WithError(scanner.Err()), "Error reading data")
 		}
+		readErr = scanner.Err()
 		close(tokenCh)
 	}()
 
-	written := 0
 	for {
+		// Stop reading while paused, letting the connection apply backpressure
+		if resumed := s.pausedUntil(); resumed != nil {
+			select {
+			case <-resumed:
+			case <-s.tomb.Dying():
+				exited = true
+				return nil
+			}
+		}
+
 		select {
 		case token, open := <-tokenCh:
 			if !open {
-				return
+				return readErr
 			}
 			if len(token) == 0 {
-				// Empty keep-alive
+				// Empty keep-alive, which also marks the end of historical events
+				if s.since != "" {
+					s.since = ""
+					if onLive := s.config.Subscription.OnLive; onLive != nil {
+						onLive()
+					}
+				}
 				continue
 			}
 			var event map[string]interface{}
-			if err := json.Unmarshal(token, &event); err != nil {
-				lg.WithError(err).Error("Failed to parse incoming event")
+			if err := s.codec.Unmarshal(token, &event); err != nil {
+				s.errors.error(lg.WithError(err), "Failed to parse incoming event")
+				continue
+			}
+			if filter := s.config.Subscription.Filter; filter != nil && !filter(event) {
+				atomic.AddInt64(&s.filtered, 1)
+				continue
+			}
+			if s.config.Subscription.Coalesce && s.coalesce(token, event) {
+				atomic.AddInt64(&s.coalesced, 1)
 				continue
 			}
 			// Now send the event to the Subscription receiver
-			select {
-			case s.Events <- event:
-				written++
-			case <-s.tomb.Dying():
+			if !s.deliver(event) {
 				exited = true
-				return
+				return nil
+			}
+			if pos := eventPosition(event); pos != "" {
+				s.positionMu.Lock()
+				s.position = pos
+				s.positionMu.Unlock()
 			}
+			atomic.AddInt64(&s.delivered, 1)
 		case <-s.tomb.Dying():
 			exited = true
-			return
+			return nil
 		}
 	}
 }
 
+// deliver sends an event to Events, discarding the oldest buffered event first
+// if the buffer is full and DropOldest is set. It returns false if the
+// Subscription was stopped before the event could be delivered.
+func (s *Subscription) deliver(event map[string]interface{}) bool {
+	if s.config.Subscription.DropOldest && cap(s.Events) > 0 {
+		for {
+			select {
+			case s.Events <- event:
+				return true
+			default:
+			}
+
+			select {
+			case <-s.Events:
+				atomic.AddInt64(&s.dropped, 1)
+			default:
+			}
+		}
+	}
+
+	select {
+	case s.Events <- event:
+		return true
+	case <-s.tomb.Dying():
+		return false
+	}
+}
+
+// coalesce returns whether an event is identical to the previous event
+func (s *Subscription) coalesce(token []byte, event map[string]interface{}) bool {
+	var same bool
+	keys := s.config.Subscription.CoalesceKeys
+	if len(keys) == 0 {
+		same = bytes.Equal(token, s.prevToken)
+		s.prevToken = append(s.prevToken[:0], token...)
+	} else {
+		same = s.prevEvent != nil
+		for _, k := range keys {
+			if !same {
+				break
+			}
+			same = reflect.DeepEqual(event[k], s.prevEvent[k])
+		}
+		s.prevEvent = event
+	}
+
+	return same
+}
+
+// SubscriptionStats are cumulative statistics about a Subscription's events
+type SubscriptionStats struct {
+	// Events dropped by the config's Subscription.Coalesce
+	Coalesced int64
+
+	// Events discarded from a full buffer by DropOldest
+	Dropped int64
+
+	// Events skipped by the config's Subscription.Filter
+	Filtered int64
+}
+
+// Stats returns a snapshot of the Subscription's cumulative statistics
+func (s *Subscription) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Coalesced: atomic.LoadInt64(&s.coalesced),
+		Dropped:   atomic.LoadInt64(&s.dropped),
+		Filtered:  atomic.LoadInt64(&s.filtered),
+	}
+}
+
+// WriteTo writes each received event to w as newline-delimited JSON until the
+// Subscription is stopped or fails. It returns the number of bytes written and
+// the error that ended the Subscription, if any.
+func (s *Subscription) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	write := func(event map[string]interface{}) error {
+		b, err := s.codec.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		n, err := w.Write(append(b, '\n'))
+		written += int64(n)
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-s.Events:
+			if !ok {
+				return written, nil
+			}
+			if err := write(event); err != nil {
+				return written, err
+			}
+		case <-s.tomb.Dead():
+			// The Subscription stopped, possibly on its own rather than by Stop,
+			// which would close Events. Write what's still buffered.
+			for {
+				select {
+				case event, ok := <-s.Events:
+					if !ok {
+						return written, s.Err()
+					}
+					if err := write(event); err != nil {
+						return written, err
+					}
+				default:
+					return written, s.Err()
+				}
+			}
+		}
+	}
+}
+
+// Pause stops delivering events to Events without disconnecting. Unread events
+// are left in the connection's buffers, so note that an extended pause may cause
+// the server to disconnect the Subscription once its own buffers fill up.
+func (s *Subscription) Pause() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if s.resumed == nil {
+		s.resumed = make(chan struct{})
+	}
+}
+
+// Resume delivering events to Events after a Pause
+func (s *Subscription) Resume() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+	}
+}
+
+// SetAPIKey replaces the API key that the Subscription authenticates with, e.g.
+// to rotate it without restarting. The current connection isn't affected, the
+// new key is used from the next reconnect. The key is unused if the config's
+// Auth is set.
+func (s *Subscription) SetAPIKey(apiKey string) {
+	s.auth.setKey(apiKey)
+}
+
+// IsPaused returns whether event delivery is paused
+func (s *Subscription) IsPaused() bool {
+	return s.pausedUntil() != nil
+}
+
+func (s *Subscription) pausedUntil() chan struct{} {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	return s.resumed
+}
+
 // IsConnected returns whether this Subscription is connected to its endpoint
 func (s *Subscription) IsConnected() bool {
-	return s.connected
+	return atomic.LoadInt32(&s.connected) == 1
+}
+
+// Delivered returns the number of events sent over Events since the
+// Subscription started, including any later discarded by DropOldest. It's safe
+// to call concurrently.
+func (s *Subscription) Delivered() int64 {
+	return atomic.LoadInt64(&s.delivered)
 }
 
 // IsRunning returns whether the Subscription is still active
@@ -194,11 +658,21 @@ func (s *Subscription) IsRunning() bool {
 	return s.tomb.Alive()
 }
 
+// Err returns the error the Subscription stopped with, or nil if it's still
+// running or was stopped by Stop
+func (s *Subscription) Err() error {
+	if err := s.tomb.Err(); err != tomb.ErrStillAlive {
+		return err
+	}
+	return nil
+}
+
 // Stop listening for events
 func (s *Subscription) Stop() error {
 	s.tomb.Kill(nil)
 	err := s.tomb.Wait()
 	close(s.Events)
+	s.errors.flush()
 
 	return err
 }
@@ -1,10 +1,15 @@
 package stride
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -76,25 +81,23 @@ func (suite *SubscriptionTestSuite) TestSubscription() {
 	start := time.Now()
 	assert.True(suite.T(), s.IsRunning())
 
-	var count int32
-	atomic.StoreInt32(&count, 0)
+	assert.Equal(suite.T(), int64(0), s.Delivered())
 	t := suite.T()
 	go func() {
 		for event := range s.Events {
-			atomic.AddInt32(&count, 1)
 			assert.Equal(t, "cartman", event["user"])
 			assert.Equal(t, "2016-10-03T22:19:51Z", event["ts"])
 		}
 	}()
 
-	for atomic.LoadInt32(&count) < 10000 && time.Since(start) < 20*time.Second {
+	for s.Delivered() < 10000 && time.Since(start) < 20*time.Second {
 		time.Sleep(100 * time.Millisecond)
 	}
 
 	assert.True(suite.T(), s.IsConnected())
-	assert.Equal(suite.T(), int32(10000), atomic.LoadInt32(&count))
+	assert.Equal(suite.T(), int64(10000), s.Delivered())
 	close(stop)
-	assert.Equal(suite.T(), int32(10000), atomic.LoadInt32(&count))
+	assert.Equal(suite.T(), int64(10000), s.Delivered())
 
 	err := s.Stop()
 	assert.Nil(suite.T(), err)
@@ -102,6 +105,659 @@ func (suite *SubscriptionTestSuite) TestSubscription() {
 	assert.False(suite.T(), s.IsRunning())
 }
 
+func (suite *SubscriptionTestSuite) TestWriteTo() {
+	stop := make(chan bool)
+	e, addr := createMockSubscribeServer(stop, 0, 3)
+
+	defer func() {
+		cxt, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		e.Shutdown(cxt)
+	}()
+
+	config := NewConfig()
+	config.Endpoint = fmt.Sprintf("http://%s/v1", addr)
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+
+	var buf bytes.Buffer
+	done := make(chan int64)
+	go func() {
+		n, err := s.WriteTo(&buf)
+		assert.Nil(suite.T(), err)
+		done <- n
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	assert.Nil(suite.T(), s.Stop())
+
+	n := <-done
+	line := `{"ts":"2016-10-03T22:19:51Z","user":"cartman"}` + "\n"
+	assert.Equal(suite.T(), strings.Repeat(line, 3), buf.String())
+	assert.Equal(suite.T(), int64(buf.Len()), n)
+}
+
+func (suite *SubscriptionTestSuite) TestWriteToError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+
+	done := make(chan error)
+	go func() {
+		_, err := s.WriteTo(ioutil.Discard)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		herr, ok := err.(*HandshakeError)
+		assert.True(suite.T(), ok)
+		assert.Equal(suite.T(), http.StatusForbidden, herr.StatusCode)
+	case <-time.After(2 * time.Second):
+		suite.T().Fatal("WriteTo didn't return after the Subscription failed")
+	}
+}
+
+func (suite *SubscriptionTestSuite) TestPauseResume() {
+	stop := make(chan bool)
+	e, addr := createMockSubscribeServer(stop, 0, 10)
+
+	defer func() {
+		cxt, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		e.Shutdown(cxt)
+	}()
+
+	config := NewConfig()
+	config.Endpoint = fmt.Sprintf("http://%s/v1", addr)
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Pause()
+	assert.True(suite.T(), s.IsPaused())
+	s.Start()
+
+	select {
+	case <-s.Events:
+		suite.T().Fatal("received event while paused")
+	case <-time.After(500 * time.Millisecond):
+	}
+	assert.True(suite.T(), s.IsConnected())
+
+	s.Resume()
+	assert.False(suite.T(), s.IsPaused())
+	for i := 0; i < 10; i++ {
+		select {
+		case event := <-s.Events:
+			assert.Equal(suite.T(), "cartman", event["user"])
+		case <-time.After(2 * time.Second):
+			suite.T().Fatal("timed out waiting for events after Resume")
+		}
+	}
+
+	close(stop)
+	assert.Nil(suite.T(), s.Stop())
+}
+
+func (suite *SubscriptionTestSuite) TestStartFrom() {
+	since := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since <- r.URL.Query().Get("since")
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"user": "kyle"}` + delimiter))
+		w.Write([]byte(delimiter))
+		w.Write([]byte(`{"user": "stan"}` + delimiter))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	live := make(chan struct{})
+	config.Subscription.OnLive = func() {
+		close(live)
+	}
+	s := newSubscription("key", "/collect/stream", config)
+	s.StartFrom(time.Date(2016, time.October, 3, 22, 19, 51, 0, time.UTC))
+	assert.Equal(suite.T(), "2016-10-03T22:19:51Z", <-since)
+
+	// Historical events are delivered before OnLive is called
+	select {
+	case <-live:
+		suite.T().Fatal("OnLive called before historical events were received")
+	case event := <-s.Events:
+		assert.Equal(suite.T(), "kyle", event["user"])
+	}
+
+	event := <-s.Events
+	assert.Equal(suite.T(), "stan", event["user"])
+	select {
+	case <-live:
+	default:
+		suite.T().Fatal("OnLive not called before live events were received")
+	}
+
+	assert.Nil(suite.T(), s.Stop())
+}
+
+func (suite *SubscriptionTestSuite) TestResume() {
+	for _, resume := range []bool{false, true} {
+		since := make(chan string, 2)
+		var mu sync.Mutex
+		connections := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			since <- r.URL.Query().Get("since")
+			mu.Lock()
+			connections++
+			first := connections == 1
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusOK)
+			if first {
+				w.Write([]byte(`{"$id": "e1", "user": "kyle"}` + delimiter))
+				w.Write([]byte(`{"$timestamp": "2016-10-03T22:19:51Z", "user": "stan"}` + delimiter))
+				w.Write([]byte(`{"user": "kenny"}` + delimiter))
+				return
+			}
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+
+		config := NewConfig()
+		config.Endpoint = server.URL + "/v1"
+		config.Subscription.InitialInterval = 10 * time.Millisecond
+		config.Subscription.Resume = resume
+
+		s := newSubscription("key", "/collect/stream", config)
+		assert.Equal(suite.T(), "", s.Position())
+		s.Start()
+		assert.Equal(suite.T(), "", <-since)
+
+		assert.Equal(suite.T(), "kyle", (<-s.Events)["user"])
+		assert.Equal(suite.T(), "stan", (<-s.Events)["user"])
+		assert.Equal(suite.T(), "kenny", (<-s.Events)["user"])
+
+		// Events without a position don't move it
+		if resume {
+			assert.Equal(suite.T(), "2016-10-03T22:19:51Z", <-since)
+		} else {
+			assert.Equal(suite.T(), "", <-since)
+		}
+		assert.Equal(suite.T(), "2016-10-03T22:19:51Z", s.Position())
+
+		assert.Nil(suite.T(), s.Stop())
+		server.Close()
+	}
+
+	assert.Equal(suite.T(), "e1", eventPosition(map[string]interface{}{ID: "e1", Timestamp: "2016-10-03T22:19:51Z"}))
+	assert.Equal(suite.T(), "42", eventPosition(map[string]interface{}{ID: float64(42)}))
+	assert.Equal(suite.T(), "", eventPosition(map[string]interface{}{"user": "kenny"}))
+}
+
+func (suite *SubscriptionTestSuite) TestCoalesce() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for _, line := range []string{
+			`{"user": "cartman", "state": "hungry", "n": 1}`,
+			`{"user": "cartman", "state": "hungry", "n": 1}`,
+			`{"user": "cartman", "state": "hungry", "n": 2}`,
+			`{"user": "cartman", "state": "full", "n": 3}`,
+			`{"user": "cartman", "state": "full", "n": 3}`,
+		} {
+			w.Write([]byte(line + delimiter))
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	receive := func(s *Subscription, n int, coalesced int64) []interface{} {
+		s.Start()
+		var received []interface{}
+		for i := 0; i < n; i++ {
+			event := <-s.Events
+			received = append(received, event["n"])
+		}
+
+		// Wait for the trailing duplicate to be coalesced
+		for start := time.Now(); s.Stats().Coalesced < coalesced && time.Since(start) < time.Second; {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Nil(suite.T(), s.Stop())
+		return received
+	}
+
+	config.Subscription.Coalesce = true
+	s := newSubscription("key", "/collect/stream", config)
+	assert.Equal(suite.T(), []interface{}{float64(1), float64(2), float64(3)}, receive(s, 3, 2))
+	assert.Equal(suite.T(), int64(2), s.Stats().Coalesced)
+
+	config.Subscription.CoalesceKeys = []string{"user", "state"}
+	s = newSubscription("key", "/collect/stream", config)
+	assert.Equal(suite.T(), []interface{}{float64(1), float64(3)}, receive(s, 2, 3))
+	assert.Equal(suite.T(), int64(3), s.Stats().Coalesced)
+}
+
+func (suite *SubscriptionTestSuite) TestHandshakeError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/collect/slow") {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "API key is read-only"}` + "\n"))
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Timeout = 100 * time.Millisecond
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+	err := s.Stop()
+	herr, ok := err.(*HandshakeError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), http.StatusForbidden, herr.StatusCode)
+	assert.Equal(suite.T(), ErrInvalidAPIKey, herr.Err)
+	assert.Equal(suite.T(), fmt.Sprintf(
+		`Subscription to %s/v1/collect/stream/subscribe failed with 403 forbidden: Invalid API key: {"error": "API key is read-only"}`,
+		server.URL), err.Error())
+
+	s = newSubscription("key", "/collect/slow", config)
+	s.Start()
+	for s.IsRunning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	herr, ok = s.Stop().(*HandshakeError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), ErrTimeout, herr.Err)
+	assert.NotNil(suite.T(), herr.Cause)
+}
+
+func (suite *SubscriptionTestSuite) TestConnectTimeout() {
+	// Accept connections but never complete a TLS handshake
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := NewConfig()
+	config.Endpoint = fmt.Sprintf("https://%s/v1", l.Addr())
+	config.Timeout = 0
+	config.Subscription.ConnectTimeout = 100 * time.Millisecond
+
+	s := newSubscription("key", "/collect/stream", config)
+	start := time.Now()
+	s.Start()
+	for s.IsRunning() && time.Since(start) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(suite.T(), time.Since(start) < time.Second)
+	herr, ok := s.Stop().(*HandshakeError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), ErrTimeout, herr.Err)
+}
+
+func (suite *SubscriptionTestSuite) TestBackOffJitter() {
+	config := NewConfig()
+	config.Subscription.InitialInterval = time.Second
+	s := newSubscription("key", "/collect/stream", config)
+
+	intervals := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		wait := s.newBackOff().NextBackOff()
+		assert.True(suite.T(), wait >= 500*time.Millisecond && wait <= 1500*time.Millisecond, wait.String())
+		intervals[wait] = true
+	}
+	assert.True(suite.T(), len(intervals) > 1)
+
+	config.Subscription.RandomizationFactor = 0
+	b := newSubscription("key", "/collect/stream", config).newBackOff()
+	assert.Equal(suite.T(), time.Second, b.NextBackOff())
+	assert.Equal(suite.T(), 2*time.Second, b.NextBackOff())
+}
+
+func (suite *SubscriptionTestSuite) TestMaxElapsedTime() {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+	config.Subscription.MaxInterval = 20 * time.Millisecond
+	config.Subscription.MaxElapsedTime = 200 * time.Millisecond
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+	assert.Nil(suite.T(), s.Err())
+
+	start := time.Now()
+	for s.IsRunning() && time.Since(start) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(suite.T(), s.IsRunning())
+	assert.Equal(suite.T(), ErrTimeout, s.Err())
+	assert.True(suite.T(), atomic.LoadInt32(&requests) > 1)
+	assert.Equal(suite.T(), ErrTimeout, s.Stop())
+}
+
+func (suite *SubscriptionTestSuite) TestRetryAfter() {
+	var mu sync.Mutex
+	var requests []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		n := len(requests)
+		mu.Unlock()
+
+		if n == 1 {
+			w.Header().Set(RetryAfterHeader, time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"i": 0}%s`, delimiter)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+	select {
+	case <-s.Events:
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("timed out waiting for an event")
+	}
+	assert.Nil(suite.T(), s.Stop())
+
+	// The HTTP-date has second resolution, so the wait is somewhat shorter
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(suite.T(), 2, len(requests))
+	assert.True(suite.T(), requests[1].Sub(requests[0]) >= time.Second)
+}
+
+func (suite *SubscriptionTestSuite) TestRetryAfterBounded() {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set(RetryAfterHeader, "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"i": 0}%s`, delimiter)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	// The wait is capped at MaxInterval
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+	config.Subscription.MaxInterval = 50 * time.Millisecond
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+	select {
+	case <-s.Events:
+	case <-time.After(5 * time.Second):
+		suite.T().Fatal("timed out waiting for an event")
+	}
+	assert.Nil(suite.T(), s.Stop())
+
+	// And gives up if it would outlast MaxElapsedTime
+	atomic.StoreInt32(&requests, 0)
+	config.Subscription.MaxInterval = time.Hour
+	config.Subscription.MaxElapsedTime = time.Minute
+
+	s = newSubscription("key", "/collect/stream", config)
+	s.Start()
+	start := time.Now()
+	for s.IsRunning() && time.Since(start) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(suite.T(), ErrTimeout, s.Err())
+	assert.Equal(suite.T(), int32(1), atomic.LoadInt32(&requests))
+}
+
+func (suite *SubscriptionTestSuite) TestTracer() {
+	var requests int32
+	spans := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spans <- r.Header.Get("Span")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	tracer := &mockTracer{}
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+	config.Tracer = tracer
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-spans:
+			assert.Equal(suite.T(), "GET /collect/stream/subscribe", name)
+		case <-time.After(5 * time.Second):
+			suite.T().Fatal("timed out waiting for a connection attempt")
+		}
+	}
+	assert.Nil(suite.T(), s.Stop())
+
+	// Each connection attempt has a span of its own
+	assert.Equal(suite.T(), []span{
+		{"GET /collect/stream/subscribe", http.StatusInternalServerError, ErrServerError},
+		{"GET /collect/stream/subscribe", http.StatusOK, nil},
+	}, tracer.finished())
+}
+
+func (suite *SubscriptionTestSuite) TestState() {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, `{"i": 0}%s`, delimiter)
+		default:
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+	config.Subscription.BufferSize = 1
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+
+	var states []ConnStatus
+	for len(states) < 7 {
+		select {
+		case state := <-s.State:
+			states = append(states, state.Status)
+			if len(states) == 2 {
+				herr, ok := state.Err.(*HandshakeError)
+				assert.True(suite.T(), ok)
+				assert.Equal(suite.T(), http.StatusInternalServerError, herr.StatusCode)
+			}
+		case <-time.After(5 * time.Second):
+			suite.T().Fatalf("timed out after states %v", states)
+		}
+	}
+	assert.Equal(suite.T(), []ConnStatus{
+		StateConnecting, StateDisconnected,
+		StateReconnecting, StateConnected, StateDisconnected,
+		StateReconnecting, StateConnected,
+	}, states)
+
+	assert.Nil(suite.T(), s.Stop())
+	var last ConnState
+	for state := range s.State {
+		last = state
+	}
+	assert.Equal(suite.T(), ConnState{Status: StateStopped}, last)
+	assert.Equal(suite.T(), "stopped", last.Status.String())
+}
+
+func (suite *SubscriptionTestSuite) TestDropOldest() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(w, `{"i": %d}%s`, i, delimiter)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.BufferSize = 3
+	config.Subscription.DropOldest = true
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+
+	start := time.Now()
+	for s.Stats().Dropped < 7 && time.Since(start) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(suite.T(), int64(7), s.Stats().Dropped)
+
+	for i := 7; i < 10; i++ {
+		assert.Equal(suite.T(), float64(i), (<-s.Events)["i"])
+	}
+	// Dropped events were delivered before they were discarded
+	for s.Delivered() < 10 && time.Since(start) < 5*time.Second {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(suite.T(), int64(10), s.Delivered())
+	assert.Nil(suite.T(), s.Stop())
+}
+
+func (suite *SubscriptionTestSuite) TestFilter() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 6; i++ {
+			fmt.Fprintf(w, `{"i": %d, "type": "%s"}%s`, i, []string{"click", "view"}[i%2], delimiter)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.Filter = func(event map[string]interface{}) bool {
+		return event["type"] == "view"
+	}
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+
+	for i := 1; i < 6; i += 2 {
+		assert.Equal(suite.T(), float64(i), (<-s.Events)["i"])
+	}
+	assert.Nil(suite.T(), s.Stop())
+	assert.Equal(suite.T(), int64(3), s.Stats().Filtered)
+	assert.Equal(suite.T(), int64(3), s.Delivered())
+}
+
+func (suite *SubscriptionTestSuite) TestLargeEvent() {
+	large := strings.Repeat("x", 100*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"data": "%s"}%s{"data": "small"}%s`, large, delimiter, delimiter)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+
+	assert.Equal(suite.T(), large, (<-s.Events)["data"])
+	assert.Equal(suite.T(), "small", (<-s.Events)["data"])
+	assert.Nil(suite.T(), s.Stop())
+}
+
+func (suite *SubscriptionTestSuite) TestMaxEventSize() {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if atomic.AddInt32(&connections, 1) == 1 {
+			fmt.Fprintf(w, `{"data": "%s"}%s`, strings.Repeat("x", 2048), delimiter)
+		}
+		fmt.Fprintf(w, `{"data": "small"}%s`, delimiter)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	config := NewConfig()
+	config.Endpoint = server.URL + "/v1"
+	config.Subscription.InitialInterval = 10 * time.Millisecond
+	config.Subscription.MaxEventSize = 1024
+
+	// Limits below the scanner's default apply too, so the oversized event ends
+	// the first connection
+	s := newSubscription("key", "/collect/stream", config)
+	s.Start()
+	assert.Equal(suite.T(), "small", (<-s.Events)["data"])
+	assert.Equal(suite.T(), int32(2), atomic.LoadInt32(&connections))
+	assert.Nil(suite.T(), s.Stop())
+}
+
 func TestSubscriptionTestSuite(t *testing.T) {
 	suite.Run(t, new(SubscriptionTestSuite))
 }